@@ -0,0 +1,230 @@
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+)
+
+// FileName is the catalog journal stored under base_data_dir
+const FileName = "catalog.jsonl"
+
+type Status string
+
+const (
+	StatusDownloaded  Status = "downloaded"
+	StatusFailed      Status = "failed"
+	StatusQuarantined Status = "quarantined"
+)
+
+// Record describes one downloaded file and where it came from
+type Record struct {
+	Repo         string    `json:"repo"`
+	Tag          string    `json:"tag,omitempty"`
+	Commit       string    `json:"commit,omitempty"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Status       Status    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+// Catalog is an append-only journal of records keyed by local path, safe
+// for concurrent use. The last record written for a path wins.
+type Catalog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	lines   int
+	records map[string]Record
+}
+
+var (
+	cfg         *config.Config
+	defaultOnce sync.Once
+	defaultCat  *Catalog
+	defaultErr  error
+)
+
+// SetConfig sets the configuration for the catalog
+func SetConfig(c *config.Config) {
+	cfg = c
+}
+
+// Open loads the catalog journal at path, creating it if needed
+func Open(path string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("create catalog directory: %w", err)
+	}
+	c := &Catalog{path: path, records: make(map[string]Record)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open catalog: %w", err)
+	}
+	c.file = f
+	return c, nil
+}
+
+func (c *Catalog) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open catalog: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || r.Path == "" {
+			continue
+		}
+		c.records[r.Path] = r
+		c.lines++
+	}
+	return scanner.Err()
+}
+
+// Put records r, replacing any previous record for the same path
+func (c *Catalog) Put(r Record) error {
+	if r.Path == "" {
+		return fmt.Errorf("catalog record without path: %s", r.URL)
+	}
+	if abs, err := filepath.Abs(r.Path); err == nil {
+		r.Path = abs
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write catalog: %w", err)
+	}
+	c.records[r.Path] = r
+	c.lines++
+	return nil
+}
+
+// Get returns the record of a local path
+func (c *Catalog) Get(path string) (Record, bool) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.records[path]
+	return r, ok
+}
+
+// Records returns the records of repo (owner/repo), or all records when
+// repo is empty, ordered by path
+func (c *Catalog) Records(repo string) []Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []Record
+	for _, r := range c.records {
+		if repo == "" || r.Repo == repo {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+	return records
+}
+
+// Close compacts the journal when it holds mostly superseded records
+func (c *Catalog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.file.Close(); err != nil {
+		return err
+	}
+	if c.lines <= 2*len(c.records) {
+		return nil
+	}
+
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range c.records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Path returns the default catalog location under base_data_dir
+func Path() string {
+	baseDataDir := "data"
+	if cfg != nil && cfg.Defaults.BaseDataDir != "" {
+		baseDataDir = cfg.Defaults.BaseDataDir
+	}
+	return filepath.Join(baseDataDir, FileName)
+}
+
+// Default returns the process wide catalog, opened on first use
+func Default() (*Catalog, error) {
+	defaultOnce.Do(func() {
+		defaultCat, defaultErr = Open(Path())
+	})
+	return defaultCat, defaultErr
+}
+
+// Put records r in the default catalog
+func Put(r Record) error {
+	c, err := Default()
+	if err != nil {
+		return err
+	}
+	return c.Put(r)
+}
+
+// Get returns the record of a local path from the default catalog
+func Get(path string) (Record, bool) {
+	c, err := Default()
+	if err != nil {
+		return Record{}, false
+	}
+	return c.Get(path)
+}
+
+// Close closes the default catalog if it was opened
+func Close() error {
+	if defaultCat == nil {
+		return nil
+	}
+	return defaultCat.Close()
+}
@@ -1,10 +1,15 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"text/tabwriter"
 
+	"github.com/Fromsko/downhub/common"
 	"github.com/Fromsko/downhub/config"
 	"github.com/Fromsko/downhub/handler"
 
@@ -12,8 +17,12 @@ import (
 )
 
 var (
-	proxy string
-	cfg   *config.Config
+	proxy     string
+	force     bool
+	strict    bool
+	jobs      int
+	selection config.Selection
+	cfg       *config.Config
 )
 
 // SetConfig sets the configuration for the command
@@ -21,7 +30,25 @@ func SetConfig(c *config.Config) {
 	cfg = c
 }
 
+// requireGithubAccess returns errGithubUnreachable after warning when
+// github.com cannot be reached directly or through proxy
+func requireGithubAccess(proxy string) error {
+	if checkAndWarnGithubAccess(proxy) {
+		return nil
+	}
+	fmt.Println("终止操作，请先通过 --proxy 参数配置好代理后再重试。")
+	return errGithubUnreachable
+}
+
 func checkAndWarnGithubAccess(proxy string) bool {
+	// Race every mirror and proxy when there is more than one route
+	if probes := handler.ProbeRoutes(context.Background(), "https://github.com/", proxy); len(probes) > 0 {
+		printProbes(probes)
+		if probes[0].Error == "" {
+			return true
+		}
+	}
+
 	// First try direct access
 	if handler.CheckGithubAccess("") {
 		return true
@@ -39,29 +66,63 @@ func checkAndWarnGithubAccess(proxy string) bool {
 	return false
 }
 
+// printProbes prints the ranking of the routes to github.com
+func printProbes(probes []handler.RouteProbe) {
+	fmt.Println("github.com 线路测速:")
+	for i, p := range probes {
+		if p.Error != "" {
+			fmt.Printf("  %d. %s: 不可用, %s\n", i+1, p.Route, p.Error)
+			continue
+		}
+		fmt.Printf("  %d. %s: %dms, %s\n", i+1, p.Route, p.Latency.Milliseconds(), common.FormatBandwidth(int64(p.Throughput)))
+	}
+}
+
+// downloadOptions collects the download pipeline options from the flags
+func downloadOptions() handler.DownloadOptions {
+	return handler.DownloadOptions{
+		Proxy:     proxy,
+		Selection: selection,
+		Force:     force,
+		Strict:    strictMode(),
+		Jobs:      jobs,
+	}
+}
+
+// addSelectionFlags registers the tag selection flags on cmd
+func addSelectionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&selection.Constraint, "constraint", "", "Semver constraint for tags (如 \">=1.20 <2\")")
+	cmd.Flags().IntVar(&selection.Latest, "latest", 0, "Only download the latest N tags")
+	cmd.Flags().StringVar(&selection.Since, "since", "", "Only tags released on or after this date (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&selection.Until, "until", "", "Only tags released on or before this date (YYYY-MM-DD)")
+	cmd.Flags().BoolVar(&selection.ExcludePrerelease, "no-prerelease", false, "Skip prerelease tags")
+	cmd.Flags().StringVar(&selection.Format, "format", "", "Only download one archive format (zip 或 tar.gz)")
+}
+
 var RootCmd = &cobra.Command{
-	Use:   "downhub",
-	Short: "DownHub is a tool for downloading GitHub repositories",
-	Args:  cobra.MaximumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 1 {
-			if !checkAndWarnGithubAccess(proxy) {
-				fmt.Println("终止操作，请先通过 --proxy 参数配置好代理后再重试。")
-				return
-			}
-			handler.DownloadRepoToDataDir(
-				args[0],
-				proxy,
-			)
-		} else {
+	Use:           "downhub",
+	Short:         "DownHub is a tool for downloading GitHub repositories",
+	Args:          usageArgs(cobra.MaximumNArgs(1)),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
 			// show help
-			if err := cmd.Help(); err != nil {
-				fmt.Fprintln(os.Stderr, err)
-			}
+			return cmd.Help()
+		}
+		if err := requireGithubAccess(proxy); err != nil {
+			return err
 		}
+		_, err := handler.DownloadRepo(cmd.Context(), args[0], downloadOptions())
+		return err
 	},
 }
 
+// addProxyFlag registers the --proxy flag of cmd
+func addProxyFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&proxy, "proxy", "p", proxy, "Proxy URL: http(s)://, socks5:// or socks5h://, user:pass@ allowed, or a PAC script pac+file:// / pac+http(s):// (如 http://localhost:7890)")
+}
+
 func init() {
 	RootCmd.CompletionOptions.DisableDefaultCmd = true
 	RootCmd.SetHelpCommand(&cobra.Command{
@@ -72,59 +133,84 @@ func init() {
 	if cfg != nil && cfg.Defaults.Proxy != "" {
 		proxy = cfg.Defaults.Proxy
 	}
-	RootCmd.Flags().StringVarP(&proxy, "proxy", "p", proxy, "Proxy URL (如 http://localhost:7890)")
-	batchCmd.Flags().StringVarP(&proxy, "proxy", "p", proxy, "Proxy URL (如 http://localhost:7890)")
+	addProxyFlag(RootCmd)
+	addProxyFlag(batchCmd)
+	addSelectionFlags(RootCmd)
+	addSelectionFlags(batchCmd)
+	RootCmd.Flags().BoolVar(&force, "force", false, "Re-download files that already exist locally")
+	batchCmd.Flags().BoolVar(&force, "force", false, "Re-download files that already exist locally")
+	batchCmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "Number of repositories processed at once")
+	RootCmd.PersistentFlags().BoolVar(&strict, "strict", false, "Treat partial failures as fatal: stop at the first failed repository and exit with its error code")
+	RootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return &usageError{err.Error()}
+	})
 	RootCmd.AddCommand(batchCmd)
 	RootCmd.AddCommand(docsCmd)
 	RootCmd.AddCommand(commonCmd)
+	RootCmd.AddCommand(statusCmd)
 }
 
 var commonCmd = &cobra.Command{
 	Use:   "common",
 	Short: "Download repositories configured in YAML file",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		if cfg == nil {
-			fmt.Println("Configuration not loaded")
-			return
+			return errors.New("configuration not loaded")
 		}
 
-		if !checkAndWarnGithubAccess(proxy) {
-			fmt.Println("终止操作，请先通过 --proxy 参数配置好代理后再重试。")
-			return
+		if err := requireGithubAccess(proxy); err != nil {
+			return err
+		}
+
+		// Download docs to base_data_dir/docs_dir/owner/repo structure
+		baseDataDir := cfg.Defaults.BaseDataDir
+		docsDir := cfg.Defaults.DocsDir
+		if baseDataDir == "" {
+			baseDataDir = "data"
+		}
+		if docsDir == "" {
+			docsDir = "docs"
 		}
 
 		// Download repositories configured in YAML
-		for _, repo := range cfg.Repositories {
-			fmt.Printf("Downloading repository: %s\n", repo.Name)
+		repos := cfg.Repositories
+		urls := make([]string, len(repos))
+		for i, repo := range repos {
+			urls[i] = repo.URL
+		}
+		return handler.EachRepo(cmd.Context(), urls, jobs, strictMode(), func(ctx context.Context, s *handler.Session, i int) error {
+			repo := repos[i]
+			s.Log.Info("Downloading repository: %s", repo.Name)
+			var errs []error
 			if repo.DownloadDocs {
-				// Download docs to base_data_dir/docs_dir/owner/repo structure
-				baseDataDir := cfg.Defaults.BaseDataDir
-				docsDir := cfg.Defaults.DocsDir
-				if baseDataDir == "" {
-					baseDataDir = "data"
-				}
-				if docsDir == "" {
-					docsDir = "docs"
+				opts := handler.DocsOptions{Dir: filepath.Join(baseDataDir, docsDir), DocsPath: repo.DocsPath, Proxy: proxy}
+				if _, err := s.DownloadDocs(ctx, repo.URL, opts); err != nil {
+					errs = append(errs, err)
 				}
-				handler.DownloadDocsToDataDir(repo.URL, repo.DocsPath, proxy, filepath.Join(baseDataDir, docsDir))
 			}
-			if repo.DownloadSource {
-				// Download source to data/source/owner/repo structure
-				handler.DownloadRepoToDataDir(repo.URL, proxy)
+			if repo.DownloadSource || repo.DownloadAssets {
+				// Download source and assets to data/source/owner/repo structure
+				if _, err := s.DownloadRepo(ctx, repo.URL, downloadOptions()); err != nil {
+					errs = append(errs, err)
+				}
 			}
-		}
+			return errors.Join(errs...)
+		})
 	},
 }
 
 func init() {
-	commonCmd.Flags().StringVarP(&proxy, "proxy", "p", proxy, "Proxy URL (如 http://localhost:7890)")
+	addProxyFlag(commonCmd)
+	addSelectionFlags(commonCmd)
+	commonCmd.Flags().BoolVar(&force, "force", false, "Re-download files that already exist locally")
+	commonCmd.Flags().IntVarP(&jobs, "jobs", "j", 1, "Number of repositories processed at once")
 }
 
 var docsCmd = &cobra.Command{
 	Use:   "docs [repo-url]",
 	Short: "Download txt and md files from a GitHub repository",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  usageArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
 		repoURL := args[0]
 		outputDir, _ := cmd.Flags().GetString("output")
 		docsPath, _ := cmd.Flags().GetString("docs-path")
@@ -149,12 +235,13 @@ var docsCmd = &cobra.Command{
 
 		// Create output directory if it doesn't exist
 		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			fmt.Printf("Error creating output directory: %v\n", err)
-			return
+			return fmt.Errorf("create output directory: %w", err)
 		}
 
 		// Download docs using the handler
-		handler.DownloadDocs(repoURL, outputDir, docsPath, proxy)
+		opts := handler.DocsOptions{Dir: outputDir, DocsPath: docsPath, Proxy: proxy}
+		_, err := handler.DownloadDocs(cmd.Context(), repoURL, opts)
+		return err
 	},
 }
 
@@ -166,7 +253,7 @@ func init() {
 var batchCmd = &cobra.Command{
 	Use:   "batch -f [file with repo URLs]",
 	Short: "Batch download repositories from a file",
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		filePath := ""
 		if len(args) > 0 {
 			filePath = args[0]
@@ -174,16 +261,79 @@ var batchCmd = &cobra.Command{
 			filePath, _ = cmd.Flags().GetString("file")
 		}
 		if filePath == "" {
-			fmt.Println("请指定包含仓库地址的文件，如: ./download batch -f repo-list.txt 或 ./download batch repo-list.txt")
-			return
+			return &usageError{"请指定包含仓库地址的文件，如: ./download batch -f repo-list.txt 或 ./download batch repo-list.txt"}
+		}
+		if err := requireGithubAccess(proxy); err != nil {
+			return err
+		}
+		_, err := handler.DownloadRepos(cmd.Context(), handler.ReadFromFile(filePath), downloadOptions())
+		return err
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status [repo-url]",
+	Short: "Show upstream tags and releases not yet downloaded",
+	Args:  usageArgs(cobra.MaximumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			return &usageError{"--output 只支持 table 或 json"}
+		}
+		if output == "json" && cfg != nil {
+			// Keep stdout valid JSON
+			cfg.Logging.Output = "stderr"
+		}
+
+		var urls []string
+		if len(args) == 1 {
+			urls = append(urls, args[0])
+		} else if cfg != nil {
+			for _, repo := range cfg.Repositories {
+				urls = append(urls, repo.URL)
+			}
 		}
-		if !checkAndWarnGithubAccess(proxy) {
-			fmt.Println("终止操作，请先通过 --proxy 参数配置好代理后再重试。")
-			return
+		if len(urls) == 0 {
+			return &usageError{"请指定仓库地址，或在配置文件 repositories 中添加仓库"}
 		}
-		handler.DownloadRepos(
-			handler.ReadFromFile(filePath),
-			proxy,
+
+		var (
+			report []handler.RepoStatus
+			errs   []error
 		)
+		for _, url := range urls {
+			status := handler.Status(cmd.Context(), url, downloadOptions())
+			report = append(report, status)
+			if status.Err != nil {
+				errs = append(errs, status.Err)
+			}
+		}
+		var err error
+		if len(errs) > 0 {
+			err = &common.BatchError{Unit: "repositories", Failed: len(errs), Total: len(report), Errs: errs}
+		}
+
+		if output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if encErr := enc.Encode(report); encErr != nil {
+				return encErr
+			}
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REPO\tUPSTREAM\tLOCAL\tNEW\tMISSING\tEXTRA\tNOTE")
+		for _, s := range report {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", s.Repo, s.Upstream, s.Local, len(s.New), len(s.Missing), len(s.Extra), s.Error)
+		}
+		w.Flush()
+		return err
 	},
 }
+
+func init() {
+	addProxyFlag(statusCmd)
+	statusCmd.Flags().StringP("output", "o", "table", "Output format (table 或 json)")
+	addSelectionFlags(statusCmd)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Fromsko/downhub/common"
+
+	"github.com/spf13/cobra"
+)
+
+// Process exit codes, see the README
+const (
+	ExitOK          = 0
+	ExitFailure     = 1   // any error not covered below
+	ExitUsage       = 2   // invalid arguments or flags
+	ExitNetwork     = 3   // github.com unreachable, timeouts, 5xx after retries
+	ExitNotFound    = 4   // repository, tag or file does not exist
+	ExitAuth        = 5   // 401/403 or git authentication failure
+	ExitChecksum    = 6   // a download did not match its published checksum
+	ExitPartial     = 7   // some files or repositories failed, the rest succeeded
+	ExitInterrupted = 130 // stopped by SIGINT/SIGTERM, the shell convention
+)
+
+// errGithubUnreachable aborts a download before it starts
+var errGithubUnreachable = errors.New("github.com unreachable")
+
+// usageError is an invalid command line
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// usageArgs reports the failures of args as usage errors
+func usageArgs(args cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, a []string) error {
+		if err := args(cmd, a); err != nil {
+			return &usageError{err.Error()}
+		}
+		return nil
+	}
+}
+
+// strictMode reports whether partial failures are fatal, from --strict or
+// download.strict
+func strictMode() bool {
+	return strict || cfg != nil && cfg.Download.Strict
+}
+
+// ExitCode maps the error returned by RootCmd.Execute to the exit code of
+// its class. Partial failures exit with ExitPartial unless strict mode
+// is on, then with the code of the failed items.
+func ExitCode(err error) int {
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usageErr):
+		return ExitUsage
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	case errors.Is(err, errGithubUnreachable):
+		return ExitNetwork
+	case !strictMode() && errors.Is(err, common.ErrPartial):
+		return ExitPartial
+	}
+
+	switch common.Classify(err) {
+	case common.ErrAuth:
+		return ExitAuth
+	case common.ErrNotFound:
+		return ExitNotFound
+	case common.ErrChecksum:
+		return ExitChecksum
+	case common.ErrNetwork:
+		return ExitNetwork
+	}
+	return ExitFailure
+}
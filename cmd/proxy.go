@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Fromsko/downhub/handler"
+
+	"github.com/spf13/cobra"
+)
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Inspect the proxy routing of network.proxy_rules",
+}
+
+var proxyExplainCmd = &cobra.Command{
+	Use:   "explain <url>",
+	Short: "Show which proxy rule a URL matches and the proxy it goes through",
+	Args:  usageArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		e, err := handler.ExplainProxy(cmd.Context(), args[0], proxy)
+		if err != nil && e.URL == "" {
+			return &usageError{err.Error()}
+		}
+		fmt.Printf("URL:   %s\n", e.URL)
+		fmt.Printf("Host:  %s\n", e.Host)
+		if e.Rule >= 0 {
+			target := e.Proxy
+			if target == "" {
+				target = "direct"
+			}
+			fmt.Printf("Rule:  #%d %s -> %s\n", e.Rule, e.Match, target)
+		} else {
+			source := e.Default
+			if source == "" {
+				source = "无"
+			}
+			fmt.Printf("Rule:  未匹配任何规则, 使用默认代理 (%s)\n", source)
+		}
+		if e.Proxy != "" {
+			fmt.Printf("Proxy: %s\n", e.Proxy)
+		} else {
+			fmt.Println("Proxy: direct")
+		}
+		if len(e.Addrs) > 0 {
+			fmt.Printf("Addrs: %s\n", strings.Join(e.Addrs, ", "))
+		}
+		return err
+	},
+}
+
+func init() {
+	addProxyFlag(proxyExplainCmd)
+	proxyCmd.AddCommand(proxyExplainCmd)
+	RootCmd.AddCommand(proxyCmd)
+}
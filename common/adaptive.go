@@ -0,0 +1,201 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// adaptiveWindow is how often throughput is sampled to decide on an
+// increase, and the least time between two decreases
+const adaptiveWindow = 2 * time.Second
+
+// AdaptiveLimit is an AIMD concurrency limit. It adds one slot per window
+// while throughput improves and halves on 429, 5xx, timeouts and
+// connection resets; a Retry-After pauses every new request.
+type AdaptiveLimit struct {
+	mu     sync.Mutex
+	name   string
+	min    int
+	max    int
+	limit  int
+	active int
+	wake   chan struct{}
+	pause  time.Time
+	// throughput of the current window and of the previous one
+	start    time.Time
+	bytes    int64
+	lastRate float64
+	lastCut  time.Time
+	errored  bool
+	log      Logger
+}
+
+// NewAdaptiveLimit returns a limit between 1 and max starting halfway,
+// logging its changes at debug level under name
+func NewAdaptiveLimit(name string, max int, log Logger) *AdaptiveLimit {
+	if max < 1 {
+		max = 1
+	}
+	return &AdaptiveLimit{
+		name:  name,
+		min:   1,
+		max:   max,
+		limit: (max + 1) / 2,
+		wake:  make(chan struct{}),
+		start: time.Now(),
+		log:   log,
+	}
+}
+
+// Limit returns the current number of slots
+func (a *AdaptiveLimit) Limit() int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// Free returns the number of slots not in use, -1 for a nil limit
+func (a *AdaptiveLimit) Free() int {
+	if a == nil {
+		return -1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return max(a.limit-a.active, 0)
+}
+
+// Acquire blocks until a slot is free and no Retry-After pause is running,
+// or ctx is done
+func (a *AdaptiveLimit) Acquire(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	for {
+		wait := time.Until(a.pause)
+		if wait <= 0 && a.active < a.limit {
+			a.active++
+			a.mu.Unlock()
+			return nil
+		}
+		wake := a.wake
+		a.mu.Unlock()
+
+		var expired <-chan time.Time
+		if wait > 0 {
+			expired = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		case <-expired:
+		}
+		a.mu.Lock()
+	}
+}
+
+// Release frees the slot of a finished request
+func (a *AdaptiveLimit) Release() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.active--
+	a.broadcast()
+	a.mu.Unlock()
+}
+
+// Observe counts n bytes transferred and, once per window, raises the
+// limit when throughput improved without errors while every slot was busy
+func (a *AdaptiveLimit) Observe(n int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.bytes += int64(n)
+	now := time.Now()
+	elapsed := now.Sub(a.start)
+	if elapsed < adaptiveWindow {
+		return
+	}
+	rate := float64(a.bytes) / elapsed.Seconds()
+	improved := rate > a.lastRate*1.05
+	if improved && !a.errored && a.active >= a.limit && a.limit < a.max && now.Sub(a.lastCut) >= 2*adaptiveWindow {
+		a.set(a.limit+1, "吞吐提升")
+	}
+	a.start, a.bytes, a.lastRate, a.errored = now, 0, rate, false
+}
+
+// Failure halves the limit when err signals an overloaded server, at most
+// once per window, and pauses new requests for its Retry-After
+func (a *AdaptiveLimit) Failure(err error) {
+	if a == nil || !IsRetryable(err) || errors.Is(err, ErrRetryable) || errors.Is(err, context.Canceled) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errored = true
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if until := time.Now().Add(statusErr.RetryAfter); until.After(a.pause) {
+			a.pause = until
+			a.debug("Retry-After, 暂停 %s", statusErr.RetryAfter)
+		}
+	}
+	if time.Since(a.lastCut) < adaptiveWindow {
+		return
+	}
+	a.lastCut = time.Now()
+	a.set(max(a.min, a.limit/2), err.Error())
+}
+
+// Reader observes the bytes read through r
+func (a *AdaptiveLimit) Reader(r io.Reader) io.Reader {
+	if a == nil {
+		return r
+	}
+	return observedReader{r: r, a: a}
+}
+
+type observedReader struct {
+	r io.Reader
+	a *AdaptiveLimit
+}
+
+func (r observedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.a.Observe(n)
+	}
+	return n, err
+}
+
+// set changes the limit and wakes the waiters, a.mu held
+func (a *AdaptiveLimit) set(limit int, reason string) {
+	if limit == a.limit {
+		return
+	}
+	a.debug("并发上限 %d -> %d (%s)", a.limit, limit, reason)
+	a.limit = limit
+	a.broadcast()
+}
+
+// broadcast wakes every Acquire, a.mu held
+func (a *AdaptiveLimit) broadcast() {
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+func (a *AdaptiveLimit) debug(msg string, args ...any) {
+	if a.log != nil {
+		a.log.Debug("自适应并发[%s]: "+msg, append([]any{a.name}, args...)...)
+	}
+}
@@ -0,0 +1,236 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+)
+
+// limiterChunk caps a single read so rate changes apply mid-transfer and
+// concurrent streams share the bandwidth evenly
+const limiterChunk = 16 << 10
+
+// Limiter is a token bucket shared by every transfer of a run. The rate is
+// looked up on each read, so schedule windows take effect while a long
+// transfer is running.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   func(now time.Time) int64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing rate(now) bytes per second, 0 or
+// less meaning unlimited
+func NewLimiter(rate func(now time.Time) int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.rate(now)
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return nil
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	// Burst of a quarter second, at least one chunk
+	if burst := max(float64(rate)/4, limiterChunk); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	return Sleep(ctx, wait)
+}
+
+// Reader paces the reads of r
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limiterChunk {
+		p = p[:limiterChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Transport paces the response bodies of rt, for transports whose reads
+// cannot be wrapped otherwise, such as the go-git ones
+func (l *Limiter) Transport(rt http.RoundTripper) http.RoundTripper {
+	if l == nil {
+		return rt
+	}
+	return limitedTransport{next: rt, l: l}
+}
+
+type limitedTransport struct {
+	next http.RoundTripper
+	l    *Limiter
+}
+
+func (t limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = limitedBody{Reader: t.l.Reader(req.Context(), resp.Body), Closer: resp.Body}
+	return resp, nil
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// BandwidthFor returns the rate, in bytes per second, that
+// download.max_bandwidth and download.bandwidth_schedule of c allow at a
+// given time: the first schedule window containing it, or max_bandwidth
+// outside of every window. Times are local, 0 means unlimited.
+func BandwidthFor(c *config.Config) (func(now time.Time) int64, error) {
+	if c == nil {
+		return func(time.Time) int64 { return 0 }, nil
+	}
+	base, err := ParseBandwidth(c.Download.MaxBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("download.max_bandwidth: %w", err)
+	}
+
+	type window struct {
+		from, to int // minutes since midnight
+		rate     int64
+	}
+	windows := make([]window, 0, len(c.Download.BandwidthSchedule))
+	for i, w := range c.Download.BandwidthSchedule {
+		from, err := parseClock(w.From)
+		if err != nil {
+			return nil, fmt.Errorf("download.bandwidth_schedule[%d].from: %w", i, err)
+		}
+		to, err := parseClock(w.To)
+		if err != nil {
+			return nil, fmt.Errorf("download.bandwidth_schedule[%d].to: %w", i, err)
+		}
+		rate, err := ParseBandwidth(w.MaxBandwidth)
+		if err != nil {
+			return nil, fmt.Errorf("download.bandwidth_schedule[%d].max_bandwidth: %w", i, err)
+		}
+		windows = append(windows, window{from, to, rate})
+	}
+
+	return func(now time.Time) int64 {
+		minute := now.Hour()*60 + now.Minute()
+		for _, w := range windows {
+			// A window ending before it starts spans midnight
+			if w.from <= w.to && minute >= w.from && minute < w.to ||
+				w.from > w.to && (minute >= w.from || minute < w.to) {
+				return w.rate
+			}
+		}
+		return base
+	}, nil
+}
+
+// ParseBandwidth parses a rate such as "20MiB/s", "500KB/s" or "1048576",
+// in bytes per second. "", "0" and "unlimited" mean no limit.
+func ParseBandwidth(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "unlimited") {
+		return 0, nil
+	}
+	rate, err := ParseSize(strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "ps"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return rate, nil
+}
+
+// ParseSize parses a byte count such as "64MiB", "500KB" or "1048576",
+// "" meaning 0
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	if num == "" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(num, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	unit := ""
+	if i >= 0 {
+		num, unit = strings.TrimSpace(num[:i]), strings.TrimSpace(num[i:])
+	}
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	units := map[string]float64{
+		"": 1, "B": 1,
+		"K": 1 << 10, "KB": 1000, "KiB": 1 << 10,
+		"M": 1 << 20, "MB": 1000 * 1000, "MiB": 1 << 20,
+		"G": 1 << 30, "GB": 1000 * 1000 * 1000, "GiB": 1 << 30,
+	}
+	factor, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, unit)
+	}
+	return int64(value * factor), nil
+}
+
+// FormatBandwidth formats a rate for logs
+func FormatBandwidth(rate int64) string {
+	switch {
+	case rate <= 0:
+		return "unlimited"
+	case rate >= 1<<20:
+		return fmt.Sprintf("%.1fMiB/s", float64(rate)/(1<<20))
+	case rate >= 1<<10:
+		return fmt.Sprintf("%.1fKiB/s", float64(rate)/(1<<10))
+	}
+	return fmt.Sprintf("%dB/s", rate)
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, "24:00" included
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
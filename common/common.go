@@ -19,24 +19,63 @@ type (
 		ProxyUrl string
 		LastTag  string
 		RepoName string
+		Tags     []Tag
+		Releases []Release
 		Spider   *colly.Collector
+
+		NoSource      bool
+		FetchAssets   bool
+		AssetIncludes []string
+		AssetExcludes []string
+		Selection     config.Selection
+		Force         bool
+		// Config is the configuration the hub was built with, nil for none
+		Config *config.Config
+		// Transports serve the spider requests through ProxyUrl
+		Transports *Transports
 	}
 	DownType struct {
-		TarGz []string `json:"tar_list,omitempty"`
-		Zip   []string `json:"zip_list,omitempty"`
+		TarGz  []string `json:"tar_list,omitempty"`
+		Zip    []string `json:"zip_list,omitempty"`
+		Assets []Asset  `json:"asset_list,omitempty"`
+	}
+	// Asset is a binary attached to a release
+	Asset struct {
+		Tag         string `json:"tag"`
+		Name        string `json:"name"`
+		Size        int64  `json:"size"`
+		ContentType string `json:"content_type"`
+		URL         string `json:"browser_download_url"`
+		// Digest is "sha256:<hex>" when the API publishes one
+		Digest string `json:"digest,omitempty"`
 	}
 	Option func(*DownHub)
+	// Logger receives printf-style log messages
+	Logger interface {
+		Debug(msg string, args ...any)
+		Info(msg string, args ...any)
+		Warn(msg string, args ...any)
+		Error(msg string, args ...any)
+	}
+	stdLogger struct{}
+	nopLogger struct{}
 )
 
-var Log = struct {
-	Info  func(string, ...interface{})
-	Warn  func(string, ...interface{})
-	Error func(string, ...interface{})
-}{
-	Info:  logs.Info,
-	Warn:  logs.Warn,
-	Error: logs.Error,
-}
+// Log writes through the logs package, configured by logs.SetConfig
+var Log Logger = stdLogger{}
+
+// NopLogger discards every message
+var NopLogger Logger = nopLogger{}
+
+func (stdLogger) Debug(msg string, args ...any) { logs.Debug(msg, args...) }
+func (stdLogger) Info(msg string, args ...any)  { logs.Info(msg, args...) }
+func (stdLogger) Warn(msg string, args ...any)  { logs.Warn(msg, args...) }
+func (stdLogger) Error(msg string, args ...any) { logs.Error(msg, args...) }
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
 
 func (d *DownType) Filter(url string) {
 	if strings.HasSuffix(url, ".zip") {
@@ -46,6 +85,34 @@ func (d *DownType) Filter(url string) {
 	}
 }
 
+// AddAsset keeps the asset if its name passes the include/exclude patterns
+func (hub *DownHub) AddAsset(asset Asset) {
+	if MatchPatterns(asset.Name, hub.AssetIncludes, hub.AssetExcludes) {
+		hub.Assets = append(hub.Assets, asset)
+	}
+}
+
+// MatchPatterns reports whether name matches one of the include globs
+// (all names when empty) and none of the exclude globs
+func MatchPatterns(name string, includes, excludes []string) bool {
+	included := len(includes) == 0
+	for _, pattern := range includes {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range excludes {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (hub *DownHub) Link() string {
 	baseLink := strings.Split(hub.BaseUrl, "https://github.com")[1]
 	repo := strings.Split(hub.BaseUrl, "/")
@@ -53,12 +120,53 @@ func (hub *DownHub) Link() string {
 	return baseLink + "/archive/refs/tags/.*"
 }
 
+// WithTransports sets the transports of the spider, by default new ones
+// are built from the hub configuration
+func WithTransports(t *Transports) Option {
+	return func(dh *DownHub) {
+		dh.Transports = t
+	}
+}
+
 func WithProxy(proxy string) Option {
 	return func(dh *DownHub) {
 		dh.ProxyUrl = proxy
 	}
 }
 
+// WithAssets enables release asset downloads filtered by name patterns
+func WithAssets(includes, excludes []string) Option {
+	return func(dh *DownHub) {
+		dh.FetchAssets = true
+		dh.AssetIncludes = includes
+		dh.AssetExcludes = excludes
+	}
+}
+
+// WithoutSource skips the zip/tar.gz source archives
+func WithoutSource() Option {
+	return func(dh *DownHub) {
+		dh.NoSource = true
+	}
+}
+
+// WithForce re-downloads files even when they already exist locally
+func WithForce(force bool) Option {
+	return func(dh *DownHub) {
+		if force {
+			dh.Force = true
+		}
+	}
+}
+
+// WithConfig builds the hub from c instead of the package configuration,
+// it must come before WithDefaultSpider
+func WithConfig(c *config.Config) Option {
+	return func(dh *DownHub) {
+		dh.Config = c
+	}
+}
+
 func WithBaseUrl(url string) Option {
 	return func(dh *DownHub) {
 		dh.BaseUrl = url
@@ -101,6 +209,15 @@ func SetConfig(c *config.Config) {
 	cfg = c
 }
 
+// SpiderParallelism returns the request parallelism of the spider: the
+// max_concurrent_downloads of c if set, otherwise 20
+func SpiderParallelism(c *config.Config) int {
+	if c != nil && c.Defaults.MaxConcurrentDownloads > 0 {
+		return c.Defaults.MaxConcurrentDownloads
+	}
+	return 20
+}
+
 func WithDefaultSpider() Option {
 	return func(dh *DownHub) {
 		if dh.Spider == nil {
@@ -109,23 +226,15 @@ func WithDefaultSpider() Option {
 
 		dh.Spider.Async = true
 
-		// Use max_concurrent_downloads from config if available, otherwise default to 20
-		parallelism := 20
-		if cfg != nil && cfg.Defaults.MaxConcurrentDownloads > 0 {
-			parallelism = cfg.Defaults.MaxConcurrentDownloads
-		}
-
 		if err := dh.Spider.Limit(&colly.LimitRule{
 			DomainGlob:  "*",
-			Parallelism: parallelism,
+			Parallelism: SpiderParallelism(dh.Config),
 		}); err != nil {
 			Log.Error("Failed to set spider limit: %v", err)
 		}
 
-		// Set user agent from config if available
-		if cfg != nil && cfg.Download.UserAgent != "" {
-			dh.Spider.UserAgent = cfg.Download.UserAgent
-		}
+		// The User-Agent of every other request, see UserAgentFor
+		dh.Spider.UserAgent = UserAgentFor(dh.Config)
 	}
 }
 
@@ -133,22 +242,31 @@ func NewDownHub(opts ...Option) *DownHub {
 	dh := &DownHub{
 		DownDir:  "", // Don't set default to avoid creating unwanted directories
 		DownType: new(DownType),
+		Config:   cfg,
 	}
 
 	for _, opt := range opts {
 		opt(dh)
 	}
+	if dh.Config != nil && dh.Config.Download.Force {
+		dh.Force = true
+	}
 
 	// Create spider if not already created
 	if dh.Spider == nil {
 		dh.Spider = colly.NewCollector()
 	}
 
-	// Set proxy if provided
-	if dh.ProxyUrl != "" {
-		if err := dh.Spider.SetProxy(dh.ProxyUrl); err != nil {
-			Log.Error("Failed to set proxy: %v", err)
-		}
+	// Send the spider requests through the shared transports, which also
+	// apply the proxy
+	if dh.Transports == nil {
+		dh.Transports = NewTransports(dh.Config)
+		dh.Transports.Log = Log
+	}
+	if rt, err := dh.Transports.RoundTripper(dh.ProxyUrl); err != nil {
+		Log.Error("Failed to set proxy: %v", err)
+	} else {
+		dh.Spider.WithTransport(rt)
 	}
 
 	return dh
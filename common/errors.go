@@ -0,0 +1,114 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Error classes, test with errors.Is or Classify
+var (
+	ErrNetwork  = errors.New("network error")
+	ErrNotFound = errors.New("not found")
+	ErrAuth     = errors.New("authentication failed")
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrPartial marks a batch where some items succeeded
+	ErrPartial = errors.New("partial failure")
+)
+
+// BatchError reports the items of a batch (files of a repository,
+// repositories of a run) that failed. It matches ErrPartial when some
+// items succeeded and the class of every failed item.
+type BatchError struct {
+	Name   string
+	Unit   string
+	Failed int
+	Total  int
+	Errs   []error
+}
+
+func (e *BatchError) Error() string {
+	msg := fmt.Sprintf("%d of %d %s failed", e.Failed, e.Total, e.Unit)
+	if e.Name != "" {
+		msg = e.Name + ": " + msg
+	}
+	return msg
+}
+
+func (e *BatchError) Unwrap() []error {
+	if e.Failed < e.Total {
+		return append([]error{ErrPartial}, e.Errs...)
+	}
+	return e.Errs
+}
+
+// Classify returns the class of err: ErrAuth, ErrNotFound, ErrChecksum or
+// ErrNetwork, in that order of precedence when a batch mixes several, and
+// nil when err fits none
+func Classify(err error) error {
+	for _, class := range []struct {
+		err   error
+		match func(error) bool
+	}{
+		{ErrAuth, isAuth},
+		{ErrNotFound, isNotFound},
+		{ErrChecksum, func(e error) bool { return e == ErrChecksum }},
+		{ErrNetwork, isNetwork},
+	} {
+		if walk(err, class.match) {
+			return class.err
+		}
+	}
+	return nil
+}
+
+// walk reports whether match holds for err or any error it wraps
+func walk(err error, match func(error) bool) bool {
+	if err == nil {
+		return false
+	}
+	if match(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return walk(e.Unwrap(), match)
+	case interface{ Unwrap() []error }:
+		for _, inner := range e.Unwrap() {
+			if walk(inner, match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isAuth(err error) bool {
+	switch err {
+	case ErrAuth, transport.ErrAuthenticationRequired, transport.ErrAuthorizationFailed, transport.ErrInvalidAuthMethod:
+		return true
+	}
+	statusErr, ok := err.(*HTTPStatusError)
+	return ok && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden)
+}
+
+func isNotFound(err error) bool {
+	if err == ErrNotFound || err == transport.ErrRepositoryNotFound {
+		return true
+	}
+	statusErr, ok := err.(*HTTPStatusError)
+	return ok && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone)
+}
+
+func isNetwork(err error) bool {
+	if err == ErrNetwork {
+		return true
+	}
+	if _, ok := err.(*BatchError); ok {
+		// Judge the items, not the batch as a whole
+		return false
+	}
+	return err != ErrRetryable && IsRetryable(err)
+}
@@ -0,0 +1,273 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+)
+
+const DefaultAPIURL = "https://api.github.com"
+
+type (
+	// Tag is a git tag and the commit it points at
+	Tag struct {
+		Name       string    `json:"name"`
+		Commit     string    `json:"commit"`
+		Date       time.Time `json:"date,omitempty"`
+		Prerelease bool      `json:"prerelease,omitempty"`
+	}
+	// Release is the part of a GitHub release downhub cares about
+	Release struct {
+		TagName     string    `json:"tag_name"`
+		Name        string    `json:"name"`
+		Draft       bool      `json:"draft"`
+		Prerelease  bool      `json:"prerelease"`
+		PublishedAt time.Time `json:"published_at"`
+		HTMLURL     string    `json:"html_url"`
+		Assets      []Asset   `json:"assets"`
+	}
+	// GitHubClient talks to the GitHub REST API
+	GitHubClient struct {
+		BaseURL   string
+		Token     string
+		UserAgent string
+		Client    *http.Client
+		Retries   int
+		Log       Logger
+	}
+)
+
+var nextLinkRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// NewGitHubClient builds an API client from the package configuration
+func NewGitHubClient(client *http.Client) *GitHubClient {
+	return NewGitHubClientFor(cfg, client)
+}
+
+// NewGitHubClientFor builds an API client from c, the token falls back to
+// the GITHUB_TOKEN and GH_TOKEN environment variables
+func NewGitHubClientFor(c *config.Config, client *http.Client) *GitHubClient {
+	gh := &GitHubClient{
+		BaseURL:   DefaultAPIURL,
+		Client:    client,
+		Retries:   3,
+		Log:       Log,
+		UserAgent: UserAgentFor(c),
+	}
+	if c != nil {
+		if c.GitHub.APIURL != "" {
+			gh.BaseURL = c.GitHub.APIURL
+		}
+		gh.Token = c.GitHub.Token
+		if c.Download.Retries != nil && *c.Download.Retries >= 0 {
+			gh.Retries = *c.Download.Retries
+		}
+	}
+	if gh.Token == "" {
+		gh.Token = os.Getenv("GITHUB_TOKEN")
+	}
+	if gh.Token == "" {
+		gh.Token = os.Getenv("GH_TOKEN")
+	}
+	if gh.Client == nil {
+		gh.Client = http.DefaultClient
+	}
+	gh.BaseURL = strings.TrimSuffix(gh.BaseURL, "/")
+	return gh
+}
+
+// Releases lists every release of owner/repo, following pagination
+func (gh *GitHubClient) Releases(ctx context.Context, owner, repo string) ([]Release, error) {
+	var releases []Release
+	next := fmt.Sprintf("%s/repos/%s/%s/releases?per_page=100", gh.BaseURL, owner, repo)
+	for next != "" {
+		var page []Release
+		link, err := gh.getJSON(ctx, next, &page)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, page...)
+		next = link
+	}
+	return releases, nil
+}
+
+// Tags lists every tag of owner/repo, following pagination
+func (gh *GitHubClient) Tags(ctx context.Context, owner, repo string) ([]Tag, error) {
+	type apiTag struct {
+		Name   string `json:"name"`
+		Commit struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+
+	var tags []Tag
+	next := fmt.Sprintf("%s/repos/%s/%s/tags?per_page=100", gh.BaseURL, owner, repo)
+	for next != "" {
+		var page []apiTag
+		link, err := gh.getJSON(ctx, next, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page {
+			tags = append(tags, Tag{Name: t.Name, Commit: t.Commit.SHA})
+		}
+		next = link
+	}
+	return tags, nil
+}
+
+// Files returns the commit ref of owner/repo points at and the paths of
+// the files in its tree
+func (gh *GitHubClient) Files(ctx context.Context, owner, repo, ref string) (string, []string, error) {
+	var commit struct {
+		SHA    string `json:"sha"`
+		Commit struct {
+			Tree struct {
+				SHA string `json:"sha"`
+			} `json:"tree"`
+		} `json:"commit"`
+	}
+	if _, err := gh.getJSON(ctx, fmt.Sprintf("%s/repos/%s/%s/commits/%s", gh.BaseURL, owner, repo, ref), &commit); err != nil {
+		return "", nil, err
+	}
+
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	if _, err := gh.getJSON(ctx, fmt.Sprintf("%s/repos/%s/%s/git/trees/%s?recursive=1", gh.BaseURL, owner, repo, commit.Commit.Tree.SHA), &tree); err != nil {
+		return "", nil, err
+	}
+	if tree.Truncated {
+		gh.Log.Warn("%s/%s 的文件列表被 GitHub 截断, 部分文件不会下载", owner, repo)
+	}
+
+	var files []string
+	for _, entry := range tree.Tree {
+		if entry.Type == "blob" {
+			files = append(files, entry.Path)
+		}
+	}
+	return commit.SHA, files, nil
+}
+
+// RawURL returns the raw.githubusercontent.com URL of a file of owner/repo
+// at ref
+func RawURL(owner, repo, ref, filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s/%s", owner, repo, ref, strings.Join(segments, "/"))
+}
+
+// getJSON decodes one API page into v and returns the next page link,
+// waiting out rate limits and Retry-After before giving up
+func (gh *GitHubClient) getJSON(ctx context.Context, url string, v any) (string, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+		if gh.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+gh.Token)
+		}
+		if gh.UserAgent != "" {
+			req.Header.Set("User-Agent", gh.UserAgent)
+		}
+
+		resp, err := gh.Client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("request %s: %w", url, err)
+		}
+
+		wait, limited := rateLimitWait(resp)
+		if limited && attempt < gh.Retries {
+			resp.Body.Close()
+			gh.Log.Warn("GitHub API rate limited, retrying in %s :> %s", wait, url)
+			if err := Sleep(ctx, wait); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("GitHub API: %w", NewHTTPStatusError(resp))
+		}
+		if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining == "0" {
+			gh.Log.Warn("GitHub API rate limit exhausted, resets at %s", rateLimitReset(resp).Format(time.TimeOnly))
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(v)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("decode %s: %w", url, err)
+		}
+
+		if m := nextLinkRegex.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			return m[1], nil
+		}
+		return "", nil
+	}
+}
+
+// rateLimitWait reports whether resp was rate limited and how long to wait
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		if secs, err := strconv.Atoi(after); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if wait := time.Until(rateLimitReset(resp)); wait > 0 {
+			return wait, true
+		}
+		return time.Second, true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return time.Minute, true
+	}
+	return 0, false
+}
+
+// rateLimitReset returns the time the current rate limit window resets
+func rateLimitReset(resp *http.Response) time.Time {
+	secs, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.Unix(secs, 0)
+}
+
+// ParseRepo extracts owner and repo from a GitHub repository URL
+// e.g., https://github.com/gin-gonic/gin -> gin-gonic, gin
+func ParseRepo(url string) (owner, repo string) {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	parts := strings.Split(strings.Trim(url, "/"), "/")
+	if len(parts) >= 3 {
+		owner = parts[1]
+		repo = strings.TrimSuffix(parts[2], ".git")
+	}
+	return
+}
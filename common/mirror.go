@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Fromsko/downhub/config"
+)
+
+// URL kinds a mirror rewrites, see config.Mirror.Kinds
+const (
+	KindArchive = "archive"
+	KindAsset   = "asset"
+	KindRaw     = "raw"
+	KindClone   = "clone"
+)
+
+// MirrorURL is one place a file is fetched from
+type MirrorURL struct {
+	// Mirror is the name of the mirror, "" for the origin
+	Mirror string
+	URL    string
+}
+
+// Source names the mirror, or the origin, for logs
+func (m MirrorURL) Source() string {
+	if m.Mirror == "" {
+		return "源站"
+	}
+	return "镜像 " + m.Mirror
+}
+
+// MirrorURLs returns where rawURL, a URL of kind, is fetched from in
+// order: its rewrite on each mirror of c that applies, then rawURL itself
+func MirrorURLs(c *config.Config, kind, rawURL string) []MirrorURL {
+	var urls []MirrorURL
+	if c != nil {
+		for i, m := range c.Mirrors {
+			mirrored, ok := RewriteURL(m, kind, rawURL)
+			if !ok || slices.ContainsFunc(urls, func(u MirrorURL) bool { return u.URL == mirrored }) {
+				continue
+			}
+			name := m.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			urls = append(urls, MirrorURL{Mirror: name, URL: mirrored})
+		}
+	}
+	return append(urls, MirrorURL{URL: rawURL})
+}
+
+// RewriteURL returns rawURL on mirror m, false when m does not serve URLs
+// of kind or of the host of rawURL. An empty kind matches every mirror.
+func RewriteURL(m config.Mirror, kind, rawURL string) (string, bool) {
+	if kind != "" && len(m.Kinds) > 0 && !slices.Contains(m.Kinds, kind) {
+		return "", false
+	}
+	if m.Prefix != "" {
+		return strings.TrimSuffix(m.Prefix, "/") + "/" + rawURL, true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	host, ok := m.Hosts[strings.ToLower(u.Host)]
+	if !ok || host == "" {
+		return "", false
+	}
+	mirrored := *u
+	mirrored.Host = host
+	return mirrored.String(), true
+}
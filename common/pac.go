@@ -0,0 +1,340 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// pacTimeout bounds the download of a PAC script and each of its calls, a
+// variable for tests
+var pacTimeout = 30 * time.Second
+
+// pacPrefix marks a proxy given as a PAC script, e.g. pac+file:///etc/proxy.pac
+const pacPrefix = "pac+"
+
+// IsPAC reports whether proxy is a PAC script URL: pac+file://, pac+http://
+// or pac+https://
+func IsPAC(proxy string) bool {
+	return strings.HasPrefix(proxy, pacPrefix)
+}
+
+// PAC evaluates a proxy auto-config script. The results of
+// FindProxyForURL are cached per scheme and host, the script is called
+// with the URL stripped to its origin.
+type PAC struct {
+	// Resolver serves dnsResolve, isResolvable and isInNet, the system
+	// resolver by default
+	Resolver Resolver
+
+	mu   sync.Mutex
+	vm   *goja.Runtime
+	find goja.Callable
+	// ctx is the context of the running call, for dnsResolve
+	ctx   context.Context
+	cache sync.Map // scheme://host -> *url.URL, nil for direct
+}
+
+// LoadPAC reads the script of a pac+file://, pac+http:// or pac+https://
+// URL. Remote scripts are always fetched directly, not through a proxy.
+func LoadPAC(ctx context.Context, src string) (*PAC, error) {
+	u, err := url.Parse(strings.TrimPrefix(src, pacPrefix))
+	if err != nil || !IsPAC(src) {
+		return nil, fmt.Errorf("invalid PAC URL %q", RedactProxy(src))
+	}
+	var script []byte
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Host != "" && u.Host != "localhost" {
+			// pac+file://proxy.pac, relative to the working directory
+			path = u.Host + u.Path
+		}
+		script, err = os.ReadFile(filepath.FromSlash(path))
+	case "http", "https":
+		script, err = fetchPAC(ctx, u.String())
+	default:
+		return nil, fmt.Errorf("invalid PAC URL %q: unsupported scheme %q", RedactProxy(src), u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load PAC %s: %w", RedactProxy(src), err)
+	}
+	pac, err := NewPAC(string(script))
+	if err != nil {
+		return nil, fmt.Errorf("load PAC %s: %w", RedactProxy(src), err)
+	}
+	return pac, nil
+}
+
+func fetchPAC(ctx context.Context, pacURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, pacTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pacURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// A proxy-less transport: the script is what tells which proxy to use
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewHTTPStatusError(resp)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// NewPAC compiles script, which must define FindProxyForURL(url, host)
+func NewPAC(script string) (*PAC, error) {
+	p := &PAC{Resolver: net.DefaultResolver, vm: goja.New(), ctx: context.Background()}
+	p.vm.Set("dnsResolve", p.dnsResolve)
+	p.vm.Set("myIpAddress", myIPAddress)
+	if _, err := p.vm.RunString(pacUtils); err != nil {
+		return nil, err
+	}
+	if _, err := p.vm.RunString(script); err != nil {
+		return nil, err
+	}
+	find, ok := goja.AssertFunction(p.vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("FindProxyForURL is not defined")
+	}
+	p.find = find
+	return p, nil
+}
+
+// FindProxy returns the proxy of u, nil for a direct connection. Only the
+// first proxy of the script result that Go supports is used: PROXY, HTTP,
+// HTTPS, SOCKS and SOCKS5 entries, or DIRECT.
+func (p *PAC) FindProxy(ctx context.Context, u *url.URL) (*url.URL, error) {
+	origin := u.Scheme + "://" + strings.ToLower(u.Host)
+	if proxy, ok := p.cache.Load(origin); ok {
+		return proxy.(*url.URL), nil
+	}
+
+	p.mu.Lock()
+	p.ctx = ctx
+	p.vm.ClearInterrupt()
+	timer := time.AfterFunc(pacTimeout, func() {
+		p.vm.Interrupt("FindProxyForURL timed out")
+	})
+	result, err := p.find(goja.Undefined(), p.vm.ToValue(origin+"/"), p.vm.ToValue(strings.ToLower(u.Hostname())))
+	timer.Stop()
+	p.ctx = context.Background()
+	p.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("PAC FindProxyForURL(%s): %w", origin, err)
+	}
+
+	proxy, err := ParsePACResult(result.String())
+	if err != nil {
+		return nil, fmt.Errorf("PAC FindProxyForURL(%s): %w", origin, err)
+	}
+	p.cache.Store(origin, proxy)
+	return proxy, nil
+}
+
+// ParsePACResult returns the first usable proxy of a FindProxyForURL
+// result such as "PROXY a:3128; SOCKS b:1080; DIRECT", nil for DIRECT
+func ParsePACResult(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			// SOCKS4 and unknown types are not supported, try the next one
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid PAC result %q", result)
+		}
+		return ParseProxy(scheme + "://" + fields[1])
+	}
+	if strings.TrimSpace(result) == "" {
+		// An empty result means direct as well
+		return nil, nil
+	}
+	return nil, fmt.Errorf("no supported proxy in PAC result %q", result)
+}
+
+// dnsResolve returns the first IPv4 address of host, null when it does not
+// resolve
+func (p *PAC) dnsResolve(host string) any {
+	ctx, cancel := context.WithTimeout(p.ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := p.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	return nil
+}
+
+// myIPAddress returns the address of the interface of the default route
+func myIPAddress() string {
+	// UDP sends nothing on connect, it only selects the route
+	conn, err := net.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// pacUtils are the PAC functions not needing DNS, dnsResolve and
+// myIpAddress are provided from Go
+const pacUtils = `
+function isPlainHostName(host) {
+	return host.indexOf('.') < 0;
+}
+
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length &&
+		host.substring(host.length - domain.length) == domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+	return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+
+function isResolvable(host) {
+	return dnsResolve(host) != null;
+}
+
+function dnsDomainLevels(host) {
+	return host.split('.').length - 1;
+}
+
+function convert_addr(ipchars) {
+	var bytes = ipchars.split('.');
+	return (((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) |
+		((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff)) >>> 0;
+}
+
+function isInNet(ipaddr, pattern, maskstr) {
+	if (!/^\d{1,3}(\.\d{1,3}){3}$/.test(ipaddr)) {
+		ipaddr = dnsResolve(ipaddr);
+		if (ipaddr == null) {
+			return false;
+		}
+	}
+	var mask = convert_addr(maskstr);
+	return ((convert_addr(ipaddr) & mask) >>> 0) == ((convert_addr(pattern) & mask) >>> 0);
+}
+
+function shExpMatch(str, shexp) {
+	var re = shexp.replace(/[.+^${}()|[\]\\]/g, '\\$&')
+		.replace(/\*/g, '.*').replace(/\?/g, '.');
+	return new RegExp('^' + re + '$').test(str);
+}
+
+var pacDays = ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'];
+var pacMonths = ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'];
+
+// pacArgs splits the trailing "GMT" off the arguments of a range function
+function pacArgs(args) {
+	var list = Array.prototype.slice.call(args);
+	var gmt = list.length > 0 && list[list.length - 1] == 'GMT';
+	if (gmt) {
+		list.pop();
+	}
+	return {list: list, gmt: gmt, now: new Date()};
+}
+
+// pacInRange reports whether from <= value <= to, wrapping around
+function pacInRange(value, from, to) {
+	return from <= to ? value >= from && value <= to : value >= from || value <= to;
+}
+
+function weekdayRange() {
+	var a = pacArgs(arguments);
+	var day = a.gmt ? a.now.getUTCDay() : a.now.getDay();
+	var from = pacDays.indexOf(a.list[0]);
+	var to = a.list.length > 1 ? pacDays.indexOf(a.list[1]) : from;
+	return from >= 0 && to >= 0 && pacInRange(day, from, to);
+}
+
+function dateRange() {
+	var a = pacArgs(arguments);
+	var n = a.list.length;
+	if (n != 1 && n != 2 && n != 4 && n != 6) {
+		return false;
+	}
+	var now = {
+		d: a.gmt ? a.now.getUTCDate() : a.now.getDate(),
+		m: a.gmt ? a.now.getUTCMonth() : a.now.getMonth(),
+		y: a.gmt ? a.now.getUTCFullYear() : a.now.getFullYear()
+	};
+	function parse(list) {
+		var date = {};
+		for (var i = 0; i < list.length; i++) {
+			var month = pacMonths.indexOf(String(list[i]).toUpperCase());
+			if (month >= 0) {
+				date.m = month;
+			} else if (list[i] > 31) {
+				date.y = +list[i];
+			} else {
+				date.d = +list[i];
+			}
+		}
+		return date;
+	}
+	var half = n == 1 ? 1 : n / 2;
+	var from = parse(a.list.slice(0, half));
+	var to = n == 1 ? from : parse(a.list.slice(half));
+	// Compare only the fields the range names, year first
+	function key(date) {
+		return (from.y !== undefined ? date.y : 0) * 10000 +
+			(from.m !== undefined ? date.m : 0) * 100 +
+			(from.d !== undefined ? date.d : 0);
+	}
+	return pacInRange(key(now), key(from), key(to));
+}
+
+function timeRange() {
+	var a = pacArgs(arguments);
+	var l = a.list;
+	var now = a.gmt ?
+		a.now.getUTCHours() * 3600 + a.now.getUTCMinutes() * 60 + a.now.getUTCSeconds() :
+		a.now.getHours() * 3600 + a.now.getMinutes() * 60 + a.now.getSeconds();
+	switch (l.length) {
+	case 1:
+		return pacInRange(now, l[0] * 3600, l[0] * 3600 + 3599);
+	case 2:
+		// The end hour is exclusive: timeRange(9, 17) ends at 16:59:59
+		return pacInRange(now, l[0] * 3600, l[1] * 3600 - 1);
+	case 4:
+		return pacInRange(now, l[0] * 3600 + l[1] * 60, l[2] * 3600 + l[3] * 60 + 59);
+	case 6:
+		return pacInRange(now, l[0] * 3600 + l[1] * 60 + l[2], l[3] * 3600 + l[4] * 60 + l[5]);
+	}
+	return false;
+}
+`
@@ -0,0 +1,242 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePACResult(t *testing.T) {
+	tests := []struct {
+		result string
+		want   string // "" for direct
+		err    bool
+	}{
+		{result: "DIRECT"},
+		{result: ""},
+		{result: "  "},
+		{result: "PROXY proxy.example:3128", want: "http://proxy.example:3128"},
+		{result: "HTTP proxy.example:3128", want: "http://proxy.example:3128"},
+		{result: "HTTPS proxy.example:443", want: "https://proxy.example:443"},
+		{result: "SOCKS socks.example:1080", want: "socks5://socks.example:1080"},
+		{result: "socks5 socks.example:1080; DIRECT", want: "socks5://socks.example:1080"},
+		{result: "SOCKS4 old.example:1080; PROXY proxy.example:3128", want: "http://proxy.example:3128"},
+		{result: "SOCKS4 old.example:1080; DIRECT"},
+		{result: "PROXY a:1; PROXY b:2", want: "http://a:1"},
+		{result: "PROXY", err: true},
+		{result: "SOCKS4 old.example:1080", err: true},
+		{result: "BOGUS x:1", err: true},
+	}
+	for _, tt := range tests {
+		proxy, err := ParsePACResult(tt.result)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParsePACResult(%q) = %v, want an error", tt.result, proxy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePACResult(%q): %v", tt.result, err)
+			continue
+		}
+		if got := proxyString(proxy); got != tt.want {
+			t.Errorf("ParsePACResult(%q) = %q, want %q", tt.result, got, tt.want)
+		}
+	}
+}
+
+// findProxy runs script for rawURL
+func findProxy(t *testing.T, script, rawURL string) (string, error) {
+	t.Helper()
+	pac, err := NewPAC(script)
+	if err != nil {
+		t.Fatalf("NewPAC: %v", err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := pac.FindProxy(context.Background(), u)
+	return proxyString(proxy), err
+}
+
+func proxyString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+// TestPACFunctions evaluates the predefined PAC functions, each expression
+// choosing between a proxy when true and DIRECT
+func TestPACFunctions(t *testing.T) {
+	now := time.Now().UTC()
+	days := []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+	months := []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	day, month, hour := int(now.Weekday()), int(now.Month())-1, now.Hour()
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`isPlainHostName("intranet")`, true},
+		{`isPlainHostName("www.example.com")`, false},
+		{`dnsDomainIs("www.example.com", ".example.com")`, true},
+		{`dnsDomainIs("www.example.org", ".example.com")`, false},
+		{`localHostOrDomainIs("www", "www.example.com")`, true},
+		{`localHostOrDomainIs("www.example.com", "www.example.com")`, true},
+		{`localHostOrDomainIs("home", "www.example.com")`, false},
+		{`dnsDomainLevels("www.example.com") == 2`, true},
+		{`shExpMatch("http://example.com/a/b.html", "*/a/*")`, true},
+		{`shExpMatch("objects.githubusercontent.com", "*.githubusercontent.com")`, true},
+		{`shExpMatch("githubusercontent.com", "*.githubusercontent.com")`, false},
+		{`shExpMatch("a.b", "a?b")`, true},
+		{`shExpMatch("axb", "a.b")`, false},
+		{`shExpMatch("a+b(c)", "a+b(c)")`, true},
+		{`isInNet("10.1.2.3", "10.0.0.0", "255.0.0.0")`, true},
+		{`isInNet("11.1.2.3", "10.0.0.0", "255.0.0.0")`, false},
+		{`isInNet("192.168.1.200", "192.168.1.128", "255.255.255.128")`, true},
+		{`isInNet("192.168.1.100", "192.168.1.128", "255.255.255.128")`, false},
+		{`isInNet("255.255.255.255", "255.255.255.0", "255.255.255.0")`, true},
+		{`convert_addr("1.2.3.4") == 16909060`, true},
+		// Ranges around now, in GMT to match time.Now().UTC(); a range
+		// whose start is after its end wraps around
+		{fmt.Sprintf(`weekdayRange("%s", "GMT")`, days[day]), true},
+		{fmt.Sprintf(`weekdayRange("%s", "%s", "GMT")`, days[(day+1)%7], days[day]), true},
+		{fmt.Sprintf(`weekdayRange("%s", "%s", "GMT")`, days[(day+1)%7], days[(day+6)%7]), false},
+		{fmt.Sprintf(`dateRange("%s", "GMT")`, months[month]), true},
+		{fmt.Sprintf(`dateRange("%s", "%s", "GMT")`, months[(month+1)%12], months[month]), true},
+		{fmt.Sprintf(`dateRange("%s", "%s", "GMT")`, months[(month+1)%12], months[(month+11)%12]), false},
+		{fmt.Sprintf(`dateRange(%d, "GMT")`, now.Year()), true},
+		{fmt.Sprintf(`dateRange(%d, %d, "GMT")`, now.Year()+1, now.Year()+2), false},
+		{`dateRange(1, 2, 3)`, false},
+		{fmt.Sprintf(`timeRange(%d, "GMT")`, hour), true},
+		{fmt.Sprintf(`timeRange(%d, %d, "GMT")`, hour, (hour+1)%24), true},
+		{fmt.Sprintf(`timeRange(%d, %d, "GMT")`, (hour+23)%24, hour), false},
+		{fmt.Sprintf(`timeRange(%d, %d, "GMT")`, (hour+1)%24, (hour+23)%24), false},
+		{fmt.Sprintf(`timeRange(%d, %d, "GMT")`, (hour+2)%24, hour), false},
+		{fmt.Sprintf(`timeRange(%d, %d, "GMT")`, (hour+2)%24, (hour+1)%24), true},
+		{`timeRange(0, 0, 0, 23, 59, 59, "GMT")`, true},
+		{`timeRange(1, 2, 3)`, false},
+	}
+	for _, tt := range tests {
+		script := fmt.Sprintf(`function FindProxyForURL(url, host) {
+			return (%s) ? "PROXY yes.example:1" : "DIRECT";
+		}`, tt.expr)
+		got, err := findProxy(t, script, "https://example.com/")
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if want := map[bool]string{true: "http://yes.example:1", false: ""}[tt.want]; got != want {
+			t.Errorf("%s = %v, want %v", tt.expr, got != "", tt.want)
+		}
+	}
+}
+
+func TestPACFindProxy(t *testing.T) {
+	script := `function FindProxyForURL(url, host) {
+		if (url != "https://" + host + "/" && url.indexOf("http://") != 0) {
+			return "PROXY bad-url.example:1";
+		}
+		if (dnsDomainIs(host, ".internal.example")) {
+			return "DIRECT";
+		}
+		if (shExpMatch(host, "*.githubusercontent.com")) {
+			return "SOCKS5 socks.example:1080; DIRECT";
+		}
+		return "PROXY proxy.example:3128";
+	}`
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://git.internal.example/a/b?c=d", ""},
+		{"https://objects.githubusercontent.com/some/file", "socks5://socks.example:1080"},
+		{"https://GitHub.com/owner/repo", "http://proxy.example:3128"},
+		{"http://example.com:8080/path", "http://proxy.example:3128"},
+	}
+	for _, tt := range tests {
+		got, err := findProxy(t, script, tt.url)
+		if err != nil {
+			t.Errorf("FindProxy(%s): %v", tt.url, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("FindProxy(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestPACCache(t *testing.T) {
+	pac, err := NewPAC(`var calls = 0;
+	function FindProxyForURL(url, host) {
+		calls++;
+		return "PROXY p" + calls + ".example:1";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/a", "http://p1.example:1"},
+		// Same origin, another path: cached
+		{"https://github.com/b?c", "http://p1.example:1"},
+		// Another scheme or host: a call each
+		{"http://github.com/a", "http://p2.example:1"},
+		{"https://api.github.com/a", "http://p3.example:1"},
+		{"https://github.com/c", "http://p1.example:1"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		proxy, err := pac.FindProxy(context.Background(), u)
+		if err != nil {
+			t.Fatalf("FindProxy(%s): %v", tt.url, err)
+		}
+		if got := proxyString(proxy); got != tt.want {
+			t.Errorf("FindProxy(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestPACTimeout(t *testing.T) {
+	saved := pacTimeout
+	pacTimeout = 100 * time.Millisecond
+	defer func() { pacTimeout = saved }()
+
+	pac, err := NewPAC(`function FindProxyForURL(url, host) {
+		if (host == "loop.example") {
+			for (;;) {}
+		}
+		return "DIRECT";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://loop.example/")
+	if _, err := pac.FindProxy(context.Background(), u); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("FindProxy of a looping script = %v, want a timeout", err)
+	}
+	// The interrupt does not outlive the call
+	u, _ = url.Parse("https://ok.example/")
+	if proxy, err := pac.FindProxy(context.Background(), u); err != nil || proxy != nil {
+		t.Fatalf("FindProxy after a timeout = %v, %v, want DIRECT", proxy, err)
+	}
+}
+
+func TestNewPACErrors(t *testing.T) {
+	for _, script := range []string{
+		`function FindProxyForURL(url, host) {`,
+		`var FindProxyForURL = 1;`,
+		`function findProxyForURL(url, host) { return "DIRECT"; }`,
+	} {
+		if _, err := NewPAC(script); err == nil {
+			t.Errorf("NewPAC(%q) succeeded, want an error", script)
+		}
+	}
+}
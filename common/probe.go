@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// probeBytes is how much of a URL a probe reads to measure throughput
+const probeBytes = 256 << 10
+
+// ProbeResult is the measurement of one route to a URL
+type ProbeResult struct {
+	// Latency is the time to the response headers
+	Latency time.Duration
+	// Throughput is in bytes per second over the whole probe, so that a
+	// slow start counts against a route as much as a slow transfer
+	Throughput float64
+	Err        error
+}
+
+// Probe fetches up to probeBytes of rawURL with client
+func Probe(ctx context.Context, client *http.Client, rawURL string) ProbeResult {
+	var result ProbeResult
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", probeBytes-1))
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.Latency = time.Since(started)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		result.Err = NewHTTPStatusError(resp)
+		return result
+	}
+	n, err := io.CopyN(io.Discard, resp.Body, probeBytes)
+	if err != nil && err != io.EOF {
+		result.Err = err
+		return result
+	}
+	result.Throughput = float64(n) / time.Since(started).Seconds()
+	return result
+}
+
+// Faster reports whether a ranks before b: working routes first, then by
+// throughput and latency
+func (a ProbeResult) Faster(b ProbeResult) bool {
+	switch {
+	case (a.Err == nil) != (b.Err == nil):
+		return a.Err == nil
+	case a.Throughput != b.Throughput:
+		return a.Throughput > b.Throughput
+	}
+	return a.Latency < b.Latency
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Fromsko/downhub/config"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ParseProxy parses a proxy URL: http, https, socks5 or socks5h, with
+// optional user:pass@ credentials. socks5 resolves host names through the
+// proxy like socks5h, as net/http does.
+func ParseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", RedactProxy(proxy))
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid proxy URL %q: unsupported scheme %q", RedactProxy(proxy), u.Scheme)
+}
+
+// RedactProxy hides the password of a proxy URL, for logs and errors
+func RedactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// Unparsable, keep only what cannot hold credentials
+		if i := strings.LastIndex(proxy, "@"); i >= 0 {
+			return "xxxxx@" + proxy[i+1:]
+		}
+		return proxy
+	}
+	return u.Redacted()
+}
+
+// ProxyFunc returns the proxy selection of a transport: proxy for every
+// request when set, otherwise HTTP_PROXY/HTTPS_PROXY of the environment.
+// Hosts matching NO_PROXY, and loopback addresses, are always reached
+// directly. A pac+ proxy is a PAC script deciding for each host instead,
+// its DNS functions resolving through resolver, the system one when nil;
+// "direct" ignores the environment and connects directly.
+func ProxyFunc(proxy string, resolver Resolver) (func(*http.Request) (*url.URL, error), error) {
+	if strings.EqualFold(proxy, ProxyDirect) {
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+	if IsPAC(proxy) {
+		pac, err := LoadPAC(context.Background(), proxy)
+		if err != nil {
+			return nil, err
+		}
+		if resolver != nil {
+			pac.Resolver = resolver
+		}
+		return func(req *http.Request) (*url.URL, error) {
+			return pac.FindProxy(req.Context(), req.URL)
+		}, nil
+	}
+	env := httpproxy.FromEnvironment()
+	if proxy != "" {
+		u, err := ParseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		env.HTTPProxy, env.HTTPSProxy = u.String(), u.String()
+	}
+	selectProxy := env.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return selectProxy(req.URL)
+	}, nil
+}
+
+// ConfiguredProxy returns the proxy to use when none is given on the
+// command line: "" when HTTP_PROXY or HTTPS_PROXY is set, the environment
+// then applies, otherwise defaults.proxy of c
+func ConfiguredProxy(c *config.Config) string {
+	if EnvProxy() || c == nil {
+		return ""
+	}
+	return c.Defaults.Proxy
+}
+
+// EnvProxy reports whether HTTP_PROXY or HTTPS_PROXY is set
+func EnvProxy() bool {
+	env := httpproxy.FromEnvironment()
+	return env.HTTPProxy != "" || env.HTTPSProxy != ""
+}
+
+// ProxyDirect is the proxy of a rule bypassing every proxy
+const ProxyDirect = "direct"
+
+type (
+	// ProxyRouter selects the proxy of each request: the first of the
+	// network.proxy_rules matching its host, or the default proxy
+	ProxyRouter struct {
+		rules    []proxyRule
+		fallback func(*http.Request) (*url.URL, error)
+		// Lookup resolves host names for CIDR rules
+		Lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+		ips    sync.Map // host -> []net.IPAddr
+	}
+	proxyRule struct {
+		match string
+		cidr  *net.IPNet
+		proxy *url.URL // nil for direct
+	}
+	// ProxyRoute is the proxy selected for a URL
+	ProxyRoute struct {
+		// Rule is the index of the matching rule, -1 when the default
+		// proxy applied
+		Rule  int
+		Match string
+		// Proxy is nil for a direct connection
+		Proxy *url.URL
+	}
+)
+
+// NewProxyRouter returns the router of rules, hosts no rule matches use
+// ProxyFunc(proxy, resolver). CIDR rules and PAC scripts resolve host
+// names through resolver, the system one when nil.
+func NewProxyRouter(rules []config.ProxyRule, proxy string, resolver Resolver) (*ProxyRouter, error) {
+	fallback, err := ProxyFunc(proxy, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	r := &ProxyRouter{fallback: fallback, Lookup: resolver.LookupIPAddr}
+	for i, rule := range rules {
+		pr := proxyRule{match: strings.ToLower(rule.Match)}
+		if pr.match == "" {
+			return nil, fmt.Errorf("network.proxy_rules[%d]: empty match", i)
+		}
+		if strings.Contains(pr.match, "/") {
+			if _, pr.cidr, err = net.ParseCIDR(pr.match); err != nil {
+				return nil, fmt.Errorf("network.proxy_rules[%d]: %w", i, err)
+			}
+		} else if _, err := path.Match(pr.match, ""); err != nil {
+			return nil, fmt.Errorf("network.proxy_rules[%d]: invalid glob %q", i, rule.Match)
+		}
+		if !strings.EqualFold(rule.Proxy, ProxyDirect) {
+			if pr.proxy, err = ParseProxy(rule.Proxy); err != nil {
+				return nil, fmt.Errorf("network.proxy_rules[%d]: %w", i, err)
+			}
+		}
+		r.rules = append(r.rules, pr)
+	}
+	return r, nil
+}
+
+// Proxy is the http.Transport.Proxy of the router
+func (r *ProxyRouter) Proxy(req *http.Request) (*url.URL, error) {
+	route, err := r.Route(req.Context(), req.URL)
+	return route.Proxy, err
+}
+
+// Route returns the proxy of u and the rule that selected it
+func (r *ProxyRouter) Route(ctx context.Context, u *url.URL) (ProxyRoute, error) {
+	host := strings.ToLower(u.Hostname())
+	for i, rule := range r.rules {
+		if r.matches(ctx, rule, host) {
+			return ProxyRoute{Rule: i, Match: rule.match, Proxy: rule.proxy}, nil
+		}
+	}
+	proxy, err := r.fallback(&http.Request{URL: u})
+	return ProxyRoute{Rule: -1, Proxy: proxy}, err
+}
+
+// matches reports whether host matches the glob of rule, or resolves
+// into its CIDR
+func (r *ProxyRouter) matches(ctx context.Context, rule proxyRule, host string) bool {
+	if rule.cidr == nil {
+		ok, _ := path.Match(rule.match, host)
+		return ok
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return rule.cidr.Contains(ip)
+	}
+	for _, addr := range r.lookup(ctx, host) {
+		if rule.cidr.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves host once per router, nil when it fails
+func (r *ProxyRouter) lookup(ctx context.Context, host string) []net.IPAddr {
+	if addrs, ok := r.ips.Load(host); ok {
+		return addrs.([]net.IPAddr)
+	}
+	addrs, err := r.Lookup(ctx, host)
+	if err != nil {
+		return nil
+	}
+	r.ips.Store(host, addrs)
+	return addrs
+}
@@ -0,0 +1,232 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver looks up the addresses of a host name, as *net.Resolver does
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// HostResolver resolves the host names pinned in network.hosts to their
+// addresses and every other one through Next
+type HostResolver struct {
+	Hosts map[string][]net.IPAddr
+	Next  Resolver
+}
+
+// NewHostResolver returns the resolver of n: network.hosts first, then
+// network.dns, the system resolver when unset
+func NewHostResolver(n config.Network) (*HostResolver, error) {
+	r := &HostResolver{Hosts: make(map[string][]net.IPAddr), Next: net.DefaultResolver}
+	for host, addrs := range n.Hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("network.hosts[%s]: invalid address %q", host, addr)
+			}
+			key := strings.ToLower(host)
+			r.Hosts[key] = append(r.Hosts[key], net.IPAddr{IP: ip})
+		}
+	}
+
+	switch dns := n.DNS; {
+	case dns == "":
+	case strings.HasPrefix(dns, "https://"):
+		r.Next = NewDoHResolver(dns, &http.Client{
+			// Direct, the DoH host itself may only be pinned in network.hosts
+			Transport: &http.Transport{DialContext: Dialer(&net.Dialer{Timeout: 10 * time.Second}, &HostResolver{Hosts: r.Hosts, Next: net.DefaultResolver})},
+			Timeout:   10 * time.Second,
+		})
+	default:
+		server := dns
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.Next = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r, nil
+}
+
+// LookupIPAddr returns the pinned addresses of host, or resolves it
+func (r *HostResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.Hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return addrs, nil
+	}
+	return r.Next.LookupIPAddr(ctx, host)
+}
+
+// Dialer returns a DialContext connecting to the addresses resolver gives
+// for the host, in order until one answers. Only the connection target
+// changes: TLS still sends and verifies the host name of the request.
+func Dialer(d *net.Dialer, resolver Resolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return d.DialContext(ctx, network, addr)
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		var firstErr error
+		for _, ip := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// DoHResolver resolves host names with DNS-over-HTTPS (RFC 8484), caching
+// the answers for their TTL
+type DoHResolver struct {
+	url    string
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohAnswer
+}
+
+type dohAnswer struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// NewDoHResolver returns a resolver querying the DoH endpoint url, e.g.
+// https://1.1.1.1/dns-query, through client
+func NewDoHResolver(url string, client *http.Client) *DoHResolver {
+	return &DoHResolver{url: url, client: client, cache: make(map[string]dohAnswer)}
+}
+
+// LookupIPAddr returns the IPv4 then the IPv6 addresses of host
+func (r *DoHResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.Lock()
+	if answer, ok := r.cache[host]; ok && time.Now().Before(answer.expires) {
+		r.mu.Unlock()
+		return answer.addrs, nil
+	}
+	r.mu.Unlock()
+
+	var (
+		addrs   []net.IPAddr
+		ttl     = uint32(300)
+		lastErr error
+	)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		got, t, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs = append(addrs, got...)
+		if len(got) > 0 {
+			ttl = min(ttl, t)
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr != nil {
+			return nil, &net.DNSError{Err: lastErr.Error(), Name: host, Server: r.url}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.url, IsNotFound: true}
+	}
+
+	r.mu.Lock()
+	r.cache[host] = dohAnswer{addrs: addrs, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// query asks the endpoint for the records of type qtype of host, returning
+// their addresses and smallest TTL
+func (r *DoHResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IPAddr, uint32, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, NewHTTPStatusError(resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var reply dnsmessage.Message
+	if err := reply.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	switch reply.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("DNS error %s", reply.RCode)
+	}
+	var (
+		addrs []net.IPAddr
+		ttl   = ^uint32(0)
+	)
+	for _, answer := range reply.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IPAddr{IP: net.IP(body.A[:])})
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IPAddr{IP: net.IP(body.AAAA[:])})
+		default:
+			// CNAMEs come with the records of their target
+			continue
+		}
+		ttl = min(ttl, answer.Header.TTL)
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,319 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newSNIServer returns a TLS server, whose certificate is valid for
+// example.com, recording the SNI of every connection
+func newSNIServer(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	// The failed handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		names = append(names, hello.ServerName)
+		mu.Unlock()
+		return nil, nil
+	}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(names)
+	}
+}
+
+// get fetches https://host:port of srv through transports t, trusting the
+// certificate of srv
+func get(t *testing.T, tr *Transports, srv *httptest.Server, host string) error {
+	t.Helper()
+	transport, err := tr.Transport(ProxyDirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + net.JoinHostPort(host, port) + "/")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Fatalf("body %q", body)
+	}
+	return nil
+}
+
+func TestHostsPin(t *testing.T) {
+	srv, sni := newSNIServer(t)
+	c := &config.Config{Network: config.Network{Hosts: map[string]config.Addrs{
+		// Falling back to the next address is covered by TestDialerOrder
+		"Example.com": {"127.0.0.1"},
+		"other.test":  {"127.0.0.1"},
+	}}}
+	tr := NewTransports(c)
+
+	if err := get(t, tr, srv, "example.com"); err != nil {
+		t.Fatalf("pinned host: %v", err)
+	}
+	if got := sni(); !slices.Equal(got, []string{"example.com"}) {
+		t.Errorf("SNI %q, want the original host name", got)
+	}
+
+	// Pinned to the same server, but its certificate is not for other.test
+	err := get(t, tr, srv, "other.test")
+	var certErr *tls.CertificateVerificationError
+	if !errors.As(err, &certErr) {
+		t.Errorf("host the certificate is not valid for: %v, want a certificate error", err)
+	}
+	if got := sni(); !slices.Equal(got, []string{"example.com", "other.test"}) {
+		t.Errorf("SNI %q, want the original host names", got)
+	}
+}
+
+func TestDialerOrder(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The first pinned address is refused before connecting, which does not
+	// depend on what the OS does with it
+	refused := net.JoinHostPort("127.0.0.2", port)
+	errRefused := errors.New("refused")
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	d := &net.Dialer{Timeout: 2 * time.Second, ControlContext: func(_ context.Context, _, address string, _ syscall.RawConn) error {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		if address == refused {
+			return errRefused
+		}
+		return nil
+	}}
+	r := &HostResolver{Hosts: map[string][]net.IPAddr{
+		"pinned.test":  {{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP("127.0.0.1")}},
+		"refused.test": {{IP: net.ParseIP("127.0.0.2")}},
+	}, Next: stubResolver{}}
+
+	conn, err := Dialer(d, r)(context.Background(), "tcp", net.JoinHostPort("pinned.test", port))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	want := []string{refused, net.JoinHostPort("127.0.0.1", port)}
+	if !slices.Equal(dialed, want) {
+		t.Errorf("dialed %q, want %q", dialed, want)
+	}
+
+	if _, err := Dialer(d, r)(context.Background(), "tcp", net.JoinHostPort("refused.test", port)); !errors.Is(err, errRefused) {
+		t.Errorf("dialing a host whose only address is refused: %v, want %v", err, errRefused)
+	}
+
+	if _, err := Dialer(d, r)(context.Background(), "tcp", net.JoinHostPort("unknown.test", port)); err == nil {
+		t.Error("dialing a host that does not resolve succeeded")
+	}
+}
+
+// stubResolver resolves nothing
+type stubResolver struct{}
+
+func (stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// newDoHServer returns a DoH endpoint answering the A records of names,
+// and the number of queries it served
+func newDoHServer(t *testing.T, names map[string]string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var queries atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		var msg dnsmessage.Message
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" || msg.Unpack(body) != nil || len(msg.Questions) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		q := msg.Questions[0]
+		reply := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: msg.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+			Questions: msg.Questions,
+		}
+		if addr, ok := names[strings.TrimSuffix(q.Name.String(), ".")]; ok {
+			reply.RCode = dnsmessage.RCodeSuccess
+			if q.Type == dnsmessage.TypeA {
+				reply.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte(net.ParseIP(addr).To4())},
+				}}
+			}
+		}
+		packed, _ := reply.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &queries
+}
+
+func TestDoHResolver(t *testing.T) {
+	doh, queries := newDoHServer(t, map[string]string{"example.com": "127.0.0.1"})
+	r := NewDoHResolver(doh.URL+"/dns-query", doh.Client())
+
+	addrs, err := r.LookupIPAddr(context.Background(), "Example.com.")
+	if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("LookupIPAddr = %v, %v, want 127.0.0.1", addrs, err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries, want A and AAAA", n)
+	}
+	// Cached for the TTL
+	if _, err := r.LookupIPAddr(context.Background(), "example.com"); err != nil || queries.Load() != 2 {
+		t.Errorf("second lookup: %v after %d queries, want the cached answer", err, queries.Load())
+	}
+
+	_, err = r.LookupIPAddr(context.Background(), "missing.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("missing host: %v, want a not found DNS error", err)
+	}
+}
+
+// TestDoHTransport resolves through a stand-in DoH resolver and a pin,
+// the server seeing the original host name either way
+func TestDoHTransport(t *testing.T) {
+	srv, sni := newSNIServer(t)
+	doh, queries := newDoHServer(t, map[string]string{"example.com": "127.0.0.1"})
+	tr := NewTransports(nil)
+	tr.Resolver = &HostResolver{
+		Hosts: map[string][]net.IPAddr{"www.example.com": {{IP: net.ParseIP("127.0.0.1")}}},
+		Next:  NewDoHResolver(doh.URL, doh.Client()),
+	}
+
+	if err := get(t, tr, srv, "example.com"); err != nil {
+		t.Fatalf("host resolved by DoH: %v", err)
+	}
+	if queries.Load() == 0 {
+		t.Error("DoH server was not queried")
+	}
+	before := queries.Load()
+	if err := get(t, tr, srv, "www.example.com"); err != nil {
+		t.Fatalf("pinned host: %v", err)
+	}
+	if queries.Load() != before {
+		t.Error("pinned host was resolved through DoH")
+	}
+	if got := sni(); !slices.Equal(got, []string{"example.com", "www.example.com"}) {
+		t.Errorf("SNI %q, want the original host names", got)
+	}
+
+	// The router of CIDR rules resolves through the same resolver
+	rules := []config.ProxyRule{{Match: "127.0.0.0/8", Proxy: "http://rule.test:1"}}
+	router, err := NewProxyRouter(rules, ProxyDirect, tr.Resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://example.com/")
+	route, err := router.Route(context.Background(), u)
+	if err != nil || route.Rule != 0 {
+		t.Errorf("Route(example.com) = %+v, %v, want the CIDR rule", route, err)
+	}
+}
+
+func TestNewHostResolver(t *testing.T) {
+	if _, err := NewHostResolver(config.Network{Hosts: map[string]config.Addrs{"a.test": {"not-an-ip"}}}); err == nil {
+		t.Error("invalid address accepted")
+	}
+	r, err := NewHostResolver(config.Network{DNS: "https://dns.test/dns-query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Next.(*DoHResolver); !ok {
+		t.Errorf("https:// DNS uses %T, want *DoHResolver", r.Next)
+	}
+	r, err = NewHostResolver(config.Network{DNS: "192.0.2.53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Next.(*net.Resolver); !ok {
+		t.Errorf("DNS server uses %T, want *net.Resolver", r.Next)
+	}
+}
+
+func TestPACResolver(t *testing.T) {
+	pac, err := NewPAC(`function FindProxyForURL(url, host) {
+		if (!isResolvable(host)) {
+			return "PROXY unresolved.test:1";
+		}
+		return isInNet(host, "10.0.0.0", "255.0.0.0") ? "DIRECT" : "PROXY outside.test:1";
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac.Resolver = &HostResolver{Hosts: map[string][]net.IPAddr{
+		"inside.test":  {{IP: net.ParseIP("10.1.2.3")}},
+		"outside.test": {{IP: net.ParseIP("192.0.2.1")}},
+	}, Next: stubResolver{}}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"inside.test", ""},
+		{"outside.test", "http://outside.test:1"},
+		{"unknown.test", "http://unresolved.test:1"},
+	}
+	for _, tt := range tests {
+		proxy, err := pac.FindProxy(context.Background(), &url.URL{Scheme: "https", Host: tt.host})
+		if err != nil {
+			t.Errorf("FindProxy(%s): %v", tt.host, err)
+			continue
+		}
+		if got := proxyString(proxy); got != tt.want {
+			t.Errorf("FindProxy(%s) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
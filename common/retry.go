@@ -0,0 +1,159 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const maxRetryDelay = 2 * time.Minute
+
+// ErrRetryable marks an error the caller wants retried regardless of its cause
+var ErrRetryable = errors.New("retryable")
+
+type (
+	// HTTPStatusError is returned for responses with an unexpected status
+	HTTPStatusError struct {
+		URL        string
+		StatusCode int
+		Status     string
+		RetryAfter time.Duration
+	}
+	// RetryPolicy controls how often and how long Retry waits between attempts
+	RetryPolicy struct {
+		Retries int
+		Delay   time.Duration
+	}
+	// RetryNotify is called before sleeping for the next attempt
+	RetryNotify func(attempt int, err error, wait time.Duration)
+)
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP error %s: %s", e.Status, e.URL)
+}
+
+// NewHTTPStatusError wraps a non-successful response, keeping Retry-After
+func NewHTTPStatusError(resp *http.Response) *HTTPStatusError {
+	err := &HTTPStatusError{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+	if secs, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil {
+		err.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return err
+}
+
+// DefaultRetryPolicy returns the policy of the package configuration
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicyFor(cfg)
+}
+
+// RetryPolicyFor returns the policy from download.retries and
+// download.retry_delay of c
+func RetryPolicyFor(c *config.Config) RetryPolicy {
+	policy := RetryPolicy{Retries: 3, Delay: 5 * time.Second}
+	if c != nil {
+		if c.Download.Retries != nil && *c.Download.Retries >= 0 {
+			policy.Retries = *c.Download.Retries
+		}
+		if c.Download.RetryDelay > 0 {
+			policy.Delay = time.Duration(c.Download.RetryDelay) * time.Second
+		}
+	}
+	return policy
+}
+
+// Retry runs fn until it succeeds, fails with a fatal error, runs out of
+// attempts or ctx is done, backing off exponentially with jitter between
+// attempts
+func Retry(ctx context.Context, policy RetryPolicy, notify RetryNotify, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || !IsRetryable(err) || attempt > policy.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := policy.backoff(attempt)
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		if notify != nil {
+			notify(attempt, err, wait)
+		}
+		if err := Sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// Sleep waits for d or until ctx is done, returning ctx.Err() in that case
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoff returns delay * 2^(attempt-1) with ±50% jitter, capped
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Delay << (attempt - 1)
+	if wait <= 0 || wait > maxRetryDelay {
+		wait = maxRetryDelay
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait)+1))
+}
+
+// IsRetryable reports whether err is transient: 5xx and 429 responses,
+// connection resets, timeouts and truncated bodies. 4xx responses,
+// missing repositories and auth failures are fatal.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrRetryable) {
+		return true
+	}
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+
+	switch {
+	case errors.Is(err, transport.ErrRepositoryNotFound),
+		errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod),
+		errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+const (
+	FormatZip   = "zip"
+	FormatTarGz = "tar.gz"
+)
+
+// WithSelection sets the tag selection policy, fields left empty keep the
+// value already on the hub so command line flags can refine repo config
+func WithSelection(sel config.Selection) Option {
+	return func(dh *DownHub) {
+		if sel.Constraint != "" {
+			dh.Selection.Constraint = sel.Constraint
+		}
+		if sel.Latest > 0 {
+			dh.Selection.Latest = sel.Latest
+		}
+		if sel.Since != "" {
+			dh.Selection.Since = sel.Since
+		}
+		if sel.Until != "" {
+			dh.Selection.Until = sel.Until
+		}
+		if sel.ExcludePrerelease {
+			dh.Selection.ExcludePrerelease = true
+		}
+		if sel.Format != "" {
+			dh.Selection.Format = sel.Format
+		}
+	}
+}
+
+// SelectTags applies the selection policy to the discovered tags, using the
+// release metadata for dates and prerelease flags when it is available
+func SelectTags(tags []Tag, releases []Release, sel config.Selection) ([]Tag, error) {
+	switch sel.Format {
+	case "", FormatZip, FormatTarGz:
+	default:
+		return nil, fmt.Errorf("unknown archive format %q (want %s or %s)", sel.Format, FormatZip, FormatTarGz)
+	}
+
+	var constraint *semver.Constraints
+	if sel.Constraint != "" {
+		c, err := semver.NewConstraint(sel.Constraint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", sel.Constraint, err)
+		}
+		constraint = c
+	}
+	since, err := parseDate(sel.Since)
+	if err != nil {
+		return nil, err
+	}
+	until, err := parseDate(sel.Until)
+	if err != nil {
+		return nil, err
+	}
+	if !until.IsZero() && len(sel.Until) == len(time.DateOnly) {
+		until = until.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	byTag := make(map[string]Release, len(releases))
+	dated := false
+	for _, release := range releases {
+		byTag[release.TagName] = release
+		dated = dated || !release.PublishedAt.IsZero()
+	}
+	for _, tag := range tags {
+		dated = dated || !tag.Date.IsZero()
+	}
+	if (!since.IsZero() || !until.IsZero()) && !dated {
+		// Filtering would drop every tag and report nothing to download
+		return nil, fmt.Errorf("no release dates known to filter tags by date, set github.use_api")
+	}
+
+	var selected []Tag
+	for _, tag := range tags {
+		version, _ := semver.NewVersion(tag.Name)
+		if release, ok := byTag[tag.Name]; ok {
+			tag.Date = release.PublishedAt
+			tag.Prerelease = release.Prerelease
+		} else if version != nil {
+			tag.Prerelease = version.Prerelease() != ""
+		}
+
+		if sel.ExcludePrerelease && tag.Prerelease {
+			continue
+		}
+		if constraint != nil && (version == nil || !constraint.Check(version)) {
+			continue
+		}
+		if !since.IsZero() && (tag.Date.IsZero() || tag.Date.Before(since)) {
+			continue
+		}
+		if !until.IsZero() && (tag.Date.IsZero() || tag.Date.After(until)) {
+			continue
+		}
+		selected = append(selected, tag)
+	}
+
+	if sel.Latest > 0 && len(selected) > sel.Latest {
+		sortNewestFirst(selected)
+		selected = selected[:sel.Latest]
+	}
+	return selected, nil
+}
+
+// sortNewestFirst orders tags by semantic version, then date, then name
+func sortNewestFirst(tags []Tag) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, erri := semver.NewVersion(tags[i].Name)
+		vj, errj := semver.NewVersion(tags[j].Name)
+		switch {
+		case erri == nil && errj == nil:
+			return vi.GreaterThan(vj)
+		case erri == nil:
+			return true
+		case errj == nil:
+			return false
+		case !tags[i].Date.Equal(tags[j].Date):
+			return tags[i].Date.After(tags[j].Date)
+		}
+		return strings.Compare(tags[i].Name, tags[j].Name) > 0
+	})
+}
+
+// parseDate accepts YYYY-MM-DD or RFC 3339 timestamps
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (want YYYY-MM-DD or RFC 3339)", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,188 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/config"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// DefaultUserAgent is sent when download.user_agent is unset
+const DefaultUserAgent = "DownHub/1.0"
+
+// Transports builds the HTTP transports of every request: downloads, the
+// GitHub API, the spider and git. One pooled transport is kept per proxy,
+// all of them sharing the timeouts, User-Agent and proxy rules of the
+// configuration.
+type Transports struct {
+	Config *config.Config
+	// Hooks wrap every round tripper, the last one outermost, e.g. for
+	// auth, tracing or rate limits
+	Hooks []func(http.RoundTripper) http.RoundTripper
+	// Resolver resolves the host names the transports dial, set from
+	// network.hosts and network.dns on first use when nil; the system
+	// resolver of net.Dialer applies when neither is configured
+	Resolver Resolver
+	Log      Logger
+
+	mu   sync.Mutex
+	pool map[string]*http.Transport
+}
+
+// NewTransports returns the transports of c, logging nothing until Log
+// is set
+func NewTransports(c *config.Config) *Transports {
+	return &Transports{Config: c, Log: NopLogger, pool: make(map[string]*http.Transport)}
+}
+
+// Transport returns the pooled transport of proxy, routing each request
+// through network.proxy_rules and then proxy, see ProxyRouter
+func (t *Transports) Transport(proxy string) (*http.Transport, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr, ok := t.pool[proxy]; ok {
+		return tr, nil
+	}
+	n := t.network()
+	if t.Resolver == nil && (len(n.Hosts) > 0 || n.DNS != "") {
+		resolver, err := NewHostResolver(n)
+		if err != nil {
+			return nil, err
+		}
+		t.Resolver = resolver
+	}
+	router, err := NewProxyRouter(n.ProxyRules, proxy, t.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   seconds(n.DialTimeout, t.timeout()),
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if t.Resolver != nil {
+		dial = Dialer(dialer, t.Resolver)
+	}
+
+	tr := &http.Transport{
+		Proxy:                 router.Proxy,
+		DialContext:           dial,
+		TLSHandshakeTimeout:   seconds(n.TLSTimeout, t.timeout()),
+		ResponseHeaderTimeout: seconds(n.ResponseHeaderTimeout, t.timeout()),
+		IdleConnTimeout:       seconds(n.IdleTimeout, 90*time.Second),
+		MaxIdleConnsPerHost:   16,
+		// HTTP/1.1 only: segmented downloads need a connection per range
+	}
+	if n.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = n.MaxIdleConnsPerHost
+	}
+	if proxy != "" && !strings.EqualFold(proxy, ProxyDirect) {
+		t.Log.Info("使用代理: %s", RedactProxy(proxy))
+	}
+	t.pool[proxy] = tr
+	return tr, nil
+}
+
+// RoundTripper returns the transport of proxy setting the User-Agent of
+// requests without one, wrapped in the hooks
+func (t *Transports) RoundTripper(proxy string) (http.RoundTripper, error) {
+	tr, err := t.Transport(proxy)
+	if err != nil {
+		return nil, err
+	}
+	var rt http.RoundTripper = userAgentTransport{next: tr, agent: UserAgentFor(t.Config)}
+	for _, hook := range t.Hooks {
+		rt = hook(rt)
+	}
+	return rt, nil
+}
+
+// Client returns a client over RoundTripper(proxy)
+func (t *Transports) Client(proxy string) (*http.Client, error) {
+	rt, err := t.RoundTripper(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+func (t *Transports) network() config.Network {
+	if t.Config == nil {
+		return config.Network{}
+	}
+	return t.Config.Network
+}
+
+// timeout returns download.timeout, the default of the network timeouts
+func (t *Transports) timeout() time.Duration {
+	if t.Config != nil && t.Config.Download.Timeout > 0 {
+		return time.Duration(t.Config.Download.Timeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func seconds(n int, fallback time.Duration) time.Duration {
+	if n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return fallback
+}
+
+// UserAgentFor returns download.user_agent of c, DefaultUserAgent if unset
+func UserAgentFor(c *config.Config) string {
+	if c != nil && c.Download.UserAgent != "" {
+		return c.Download.UserAgent
+	}
+	return DefaultUserAgent
+}
+
+type userAgentTransport struct {
+	next  http.RoundTripper
+	agent string
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.agent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+type roundTripperKey struct{}
+
+// WithRoundTripper returns a context whose go-git requests are sent
+// through rt, see InstallGitTransport
+func WithRoundTripper(ctx context.Context, rt http.RoundTripper) context.Context {
+	return context.WithValue(ctx, roundTripperKey{}, rt)
+}
+
+var gitTransportOnce sync.Once
+
+// InstallGitTransport routes the HTTP(S) traffic of go-git, which only
+// supports process-wide transports, through the round tripper of each
+// request context, http.DefaultTransport when there is none. It replaces
+// the http and https clients of go-git for the whole process, once.
+func InstallGitTransport() {
+	gitTransportOnce.Do(func() {
+		c := githttp.NewClient(&http.Client{Transport: contextTransport{}})
+		client.InstallProtocol("https", c)
+		client.InstallProtocol("http", c)
+	})
+}
+
+type contextTransport struct{}
+
+func (contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := req.Context().Value(roundTripperKey{}).(http.RoundTripper); ok {
+		return rt.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
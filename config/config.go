@@ -9,32 +9,50 @@ import (
 
 // Config represents the downhub configuration structure
 type Config struct {
-	Defaults    Defaults     `yaml:"defaults"`
+	Defaults     Defaults     `yaml:"defaults"`
 	Repositories []Repository `yaml:"repositories"`
-	FileFilters FileFilters  `yaml:"file_filters"`
-	Download    Download     `yaml:"download"`
-	Logging     Logging      `yaml:"logging"`
-	Advanced    Advanced     `yaml:"advanced"`
+	FileFilters  FileFilters  `yaml:"file_filters"`
+	Download     Download     `yaml:"download"`
+	Logging      Logging      `yaml:"logging"`
+	Advanced     Advanced     `yaml:"advanced"`
+	GitHub       GitHub       `yaml:"github"`
+	Network      Network      `yaml:"network"`
+	// Mirrors are tried in order before the origin
+	Mirrors []Mirror `yaml:"mirrors"`
 }
 
 // Defaults contains default configuration values
 type Defaults struct {
-	BaseDataDir string `yaml:"base_data_dir"`
-	DocsDir     string `yaml:"docs_dir"`
-	SourceDir   string `yaml:"source_dir"`
-	DocsPath    string `yaml:"docs_path"`
+	BaseDataDir            string `yaml:"base_data_dir"`
+	DocsDir                string `yaml:"docs_dir"`
+	SourceDir              string `yaml:"source_dir"`
+	DocsPath               string `yaml:"docs_path"`
 	MaxConcurrentDownloads int    `yaml:"max_concurrent_downloads"`
-	Proxy                 string `yaml:"proxy"`
+	Proxy                  string `yaml:"proxy"`
 }
 
 // Repository represents a GitHub repository configuration
 type Repository struct {
-	Name           string `yaml:"name"`
-	URL            string `yaml:"url"`
-	DownloadDocs   bool   `yaml:"download_docs"`
-	DownloadSource bool   `yaml:"download_source"`
-	OutputDir      string `yaml:"output_dir"`
-	DocsPath       string `yaml:"docs_path"`
+	Name           string    `yaml:"name"`
+	URL            string    `yaml:"url"`
+	DownloadDocs   bool      `yaml:"download_docs"`
+	DownloadSource bool      `yaml:"download_source"`
+	OutputDir      string    `yaml:"output_dir"`
+	DocsPath       string    `yaml:"docs_path"`
+	DownloadAssets bool      `yaml:"download_assets"`
+	AssetInclude   []string  `yaml:"asset_include"`
+	AssetExclude   []string  `yaml:"asset_exclude"`
+	Selection      Selection `yaml:"selection"`
+}
+
+// Selection narrows down which tags of a repository are downloaded
+type Selection struct {
+	Constraint        string `yaml:"constraint"`
+	Latest            int    `yaml:"latest"`
+	Since             string `yaml:"since"`
+	Until             string `yaml:"until"`
+	ExcludePrerelease bool   `yaml:"exclude_prerelease"`
+	Format            string `yaml:"format"`
 }
 
 // FileFilters contains file inclusion and exclusion patterns
@@ -45,10 +63,33 @@ type FileFilters struct {
 
 // Download contains download-related settings
 type Download struct {
-	Timeout     int `yaml:"timeout"`
-	Retries     int `yaml:"retries"`
-	RetryDelay  int `yaml:"retry_delay"`
-	UserAgent   string `yaml:"user_agent"`
+	Timeout    int            `yaml:"timeout"`
+	Retries    *int           `yaml:"retries"` // nil when unset, meaning 3
+	RetryDelay int            `yaml:"retry_delay"`
+	UserAgent  string         `yaml:"user_agent"`
+	Force      bool           `yaml:"force"`
+	Strict     bool           `yaml:"strict"`
+	MaxPerHost int            `yaml:"max_per_host"`
+	HostLimits map[string]int `yaml:"host_limits"`
+	// MaxBandwidth caps the combined rate of every download and git
+	// transfer, e.g. "20MiB/s"; empty means unlimited
+	MaxBandwidth      string            `yaml:"max_bandwidth"`
+	BandwidthSchedule []BandwidthWindow `yaml:"bandwidth_schedule"`
+	// Segments is the number of ranges a large file is fetched in at once,
+	// 0 or 1 downloads it as one stream
+	Segments       int    `yaml:"segments"`
+	SegmentMinSize string `yaml:"segment_min_size"`
+	// Adaptive lets the spider and the download pool run below their
+	// configured parallelism, backing off on 429, 5xx and timeouts
+	Adaptive bool `yaml:"adaptive"`
+}
+
+// BandwidthWindow overrides max_bandwidth between two local times of day,
+// e.g. full speed from 00:00 to 07:00. From after To spans midnight.
+type BandwidthWindow struct {
+	From         string `yaml:"from"`
+	To           string `yaml:"to"`
+	MaxBandwidth string `yaml:"max_bandwidth"`
 }
 
 // Logging contains logging configuration
@@ -60,9 +101,84 @@ type Logging struct {
 
 // Advanced contains advanced configuration options
 type Advanced struct {
-	PreserveStructure  bool `yaml:"preserve_structure"`
-	CreateReadme       bool `yaml:"create_readme"`
-	ValidateChecksums  bool `yaml:"validate_checksums"`
+	PreserveStructure bool `yaml:"preserve_structure"`
+	CreateReadme      bool `yaml:"create_readme"`
+	ValidateChecksums bool `yaml:"validate_checksums"`
+}
+
+// GitHub contains GitHub REST API settings
+type GitHub struct {
+	UseAPI bool   `yaml:"use_api"`
+	APIURL string `yaml:"api_url"`
+	Token  string `yaml:"token"`
+}
+
+// Network contains the connection settings shared by every HTTP and git
+// transport, in seconds; the timeouts default to download.timeout
+type Network struct {
+	DialTimeout           int `yaml:"dial_timeout"`
+	TLSTimeout            int `yaml:"tls_timeout"`
+	ResponseHeaderTimeout int `yaml:"response_header_timeout"`
+	IdleTimeout           int `yaml:"idle_timeout"`
+	MaxIdleConnsPerHost   int `yaml:"max_idle_conns_per_host"`
+	// ProxyRules route hosts to a proxy or direct, the first match wins;
+	// unmatched hosts use the default proxy
+	ProxyRules []ProxyRule `yaml:"proxy_rules"`
+	Probe      Probe       `yaml:"probe"`
+	// Hosts pins host names to addresses, like /etc/hosts
+	Hosts map[string]Addrs `yaml:"hosts"`
+	// DNS resolves the other host names: host[:port] of a DNS server or an
+	// https:// DNS-over-HTTPS URL, the system resolver when empty
+	DNS string `yaml:"dns"`
+}
+
+// Addrs is a list of addresses, written as one string or a sequence
+type Addrs []string
+
+// UnmarshalYAML accepts a single address as well as a list
+func (a *Addrs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*a = Addrs{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Probe races the routes to each download host, every mirror and the
+// origin through every proxy and directly, and sends the downloads down
+// the fastest one
+type Probe struct {
+	Enabled bool `yaml:"enabled"`
+	// Proxies are raced besides the default proxy, "direct" for direct
+	// connections
+	Proxies []string `yaml:"proxies"`
+	// Interval is how long in seconds a ranking is used, across runs
+	// through the cache file, before the host is probed again; 300 when 0
+	Interval int `yaml:"interval"`
+}
+
+// ProxyRule sends the hosts matching Match, a host glob or a CIDR, through
+// Proxy, a proxy URL or "direct"
+type ProxyRule struct {
+	Match string `yaml:"match"`
+	Proxy string `yaml:"proxy"`
+}
+
+// Mirror rewrites GitHub URLs to an accelerator mirror, either prefixing
+// the whole URL with Prefix, e.g. https://mirror.example/https://github.com/...,
+// or replacing the hosts listed in Hosts
+type Mirror struct {
+	Name   string            `yaml:"name"`
+	Prefix string            `yaml:"prefix"`
+	Hosts  map[string]string `yaml:"hosts"`
+	// Kinds limits the mirror to archive, asset, raw and clone URLs, all of
+	// them when empty
+	Kinds []string `yaml:"kinds"`
 }
 
 // LoadConfig loads configuration from a YAML file
@@ -98,14 +214,15 @@ func SaveConfig(config *Config, filename string) error {
 
 // GetDefaultConfig returns a default configuration
 func GetDefaultConfig() *Config {
+	retries := 3
 	return &Config{
 		Defaults: Defaults{
-			BaseDataDir: "data",
-			DocsDir:     "docs",
-			SourceDir:   "source",
-			DocsPath:    "docs",
+			BaseDataDir:            "data",
+			DocsDir:                "docs",
+			SourceDir:              "source",
+			DocsPath:               "docs",
 			MaxConcurrentDownloads: 5,
-			Proxy:                 "http://localhost:7890",
+			Proxy:                  "http://localhost:7890",
 		},
 		FileFilters: FileFilters{
 			Include: []string{"*.md", "*.txt", "*.yaml", "*.yml"},
@@ -113,9 +230,11 @@ func GetDefaultConfig() *Config {
 		},
 		Download: Download{
 			Timeout:    300,
-			Retries:    3,
+			Retries:    &retries,
 			RetryDelay: 5,
 			UserAgent:  "Downhub/1.0",
+			Segments:   4,
+			Adaptive:   true,
 		},
 		Logging: Logging{
 			Level:  "info",
@@ -127,5 +246,9 @@ func GetDefaultConfig() *Config {
 			CreateReadme:      true,
 			ValidateChecksums: false,
 		},
+		GitHub: GitHub{
+			UseAPI: false,
+			APIURL: "https://api.github.com",
+		},
 	}
 }
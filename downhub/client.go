@@ -0,0 +1,170 @@
+// Package downhub embeds downhub in other programs. A Client carries its
+// own configuration, HTTP client, logger, progress sink and catalog, so it
+// does not depend on the SetConfig globals used by the command line.
+package downhub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Fromsko/downhub/catalog"
+	"github.com/Fromsko/downhub/common"
+	"github.com/Fromsko/downhub/config"
+	"github.com/Fromsko/downhub/handler"
+)
+
+type (
+	Tag             = common.Tag
+	Logger          = common.Logger
+	Progress        = handler.Progress
+	FileProgress    = handler.FileProgress
+	DownloadOptions = handler.DownloadOptions
+	DocsOptions     = handler.DocsOptions
+	FileResult      = handler.FileResult
+	RepoResult      = handler.RepoResult
+	DocsResult      = handler.DocsResult
+	RepoStatus      = handler.RepoStatus
+	BatchError      = common.BatchError
+
+	// Client downloads GitHub repositories, safe for concurrent use
+	Client struct {
+		session *handler.Session
+	}
+	Option func(*Client)
+)
+
+// ErrInvalidURL is returned for URLs that are not GitHub repositories
+var ErrInvalidURL = errors.New("not a GitHub repository URL")
+
+// Error classes of the errors returned by Client, see Classify
+var (
+	ErrNetwork  = common.ErrNetwork
+	ErrNotFound = common.ErrNotFound
+	ErrAuth     = common.ErrAuth
+	ErrChecksum = common.ErrChecksum
+	ErrPartial  = common.ErrPartial
+)
+
+// Classify returns the class of an error returned by Client, nil when it
+// fits none
+func Classify(err error) error {
+	return common.Classify(err)
+}
+
+// WithHTTPClient sends every HTTP request through client, which then owns
+// proxy and timeout settings
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.session.HTTP = client
+	}
+}
+
+// WithLogger sets the logger, messages are discarded by default
+func WithLogger(logger Logger) Option {
+	return func(c *Client) {
+		if logger != nil {
+			c.session.Log = logger
+			c.session.Transports.Log = logger
+		}
+	}
+}
+
+// WithProgress reports download progress to the sink newProgress creates
+// for every repository, progress is not reported by default
+func WithProgress(newProgress func(repo string) Progress) Option {
+	return func(c *Client) {
+		c.session.NewProgress = newProgress
+	}
+}
+
+// WithTransportHook wraps the round tripper of every HTTP request, e.g.
+// for auth, tracing or rate limits. Hooks added later wrap earlier ones;
+// they do not apply with WithHTTPClient.
+func WithTransportHook(hook func(http.RoundTripper) http.RoundTripper) Option {
+	return func(c *Client) {
+		c.session.Transports.Hooks = append(c.session.Transports.Hooks, hook)
+	}
+}
+
+// WithGitTransport sends the git traffic of ListTags and DownloadDocs
+// through the client, with its proxy, hooks and bandwidth limit. go-git
+// only supports process-wide transports: this replaces the http and https
+// clients installed in go-git for the whole process, including for git
+// operations outside downhub, which then use http.DefaultTransport. Off by
+// default, git then uses the go-git clients already installed.
+func WithGitTransport() Option {
+	return func(c *Client) {
+		c.session.GitTransport = true
+	}
+}
+
+// WithCatalog records downloads in cat and skips files it already lists,
+// no catalog is kept by default
+func WithCatalog(cat *catalog.Catalog) Option {
+	return func(c *Client) {
+		c.session.Catalog = cat
+	}
+}
+
+// NewClient returns a client configured by cfg, nil uses the built-in
+// defaults. cfg is not copied and must not change while the client is used.
+// It changes no process-wide state unless WithGitTransport is given.
+func NewClient(cfg *config.Config, opts ...Option) *Client {
+	c := &Client{session: handler.NewSession(cfg)}
+	c.session.Log = common.NopLogger
+	c.session.Transports.Log = common.NopLogger
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ListTags returns the tags of a repository that the selection of opts and
+// of the configured repository let through
+func (c *Client) ListTags(ctx context.Context, repoURL string, opts DownloadOptions) ([]Tag, error) {
+	if err := checkURL(repoURL); err != nil {
+		return nil, err
+	}
+	return c.session.Tags(ctx, repoURL, opts)
+}
+
+// DownloadReleases downloads the source archives and release assets of the
+// selected tags. The result is returned even when some files failed.
+func (c *Client) DownloadReleases(ctx context.Context, repoURL string, opts DownloadOptions) (*RepoResult, error) {
+	if err := checkURL(repoURL); err != nil {
+		return nil, err
+	}
+	return c.session.DownloadRepo(ctx, repoURL, opts)
+}
+
+// DownloadDocs exports the documentation files of the default branch. The
+// result is returned even when some files failed.
+func (c *Client) DownloadDocs(ctx context.Context, repoURL string, opts DocsOptions) (*DocsResult, error) {
+	if err := checkURL(repoURL); err != nil {
+		return nil, err
+	}
+	return c.session.DownloadDocs(ctx, repoURL, opts)
+}
+
+// Status compares the upstream artifacts of a repository with the local
+// ones without downloading anything. The error is that of the tag
+// discovery or selection, the status then lists no files.
+func (c *Client) Status(ctx context.Context, repoURL string, opts DownloadOptions) (RepoStatus, error) {
+	if err := checkURL(repoURL); err != nil {
+		return RepoStatus{}, err
+	}
+	status := c.session.Status(ctx, repoURL, opts)
+	return status, status.Err
+}
+
+// checkURL rejects URLs the handlers cannot derive owner/repo from
+func checkURL(repoURL string) error {
+	owner, repo := common.ParseRepo(repoURL)
+	if !strings.HasPrefix(repoURL, "https://github.com/") || owner == "" || repo == "" {
+		return fmt.Errorf("%w: %s", ErrInvalidURL, repoURL)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Fromsko/downhub/common"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// adaptive returns the adaptive concurrency limits of the spider and of
+// the download pool, both nil when download.adaptive is off. The
+// configured parallelism is their ceiling.
+func (s *Session) adaptive() (spider, pool *common.AdaptiveLimit) {
+	if s.parent != nil {
+		return s.parent.adaptive()
+	}
+	s.adaptOnce.Do(func() {
+		if s.Config == nil || !s.Config.Download.Adaptive {
+			return
+		}
+		s.spiderLim = common.NewAdaptiveLimit("spider", common.SpiderParallelism(s.Config), s.Log)
+		s.poolLim = common.NewAdaptiveLimit("download", s.poolSize(), s.Log)
+	})
+	return s.spiderLim, s.poolLim
+}
+
+// poolLimit returns the adaptive limit of the download pool, nil when off
+func (s *Session) poolLimit() *common.AdaptiveLimit {
+	_, pool := s.adaptive()
+	return pool
+}
+
+// throttleSpider admits the requests of c through the adaptive spider
+// limit, below the parallelism of its LimitRule
+func (s *Session) throttleSpider(c *colly.Collector) {
+	limit, _ := s.adaptive()
+	if limit == nil {
+		return
+	}
+	c.OnRequest(func(r *colly.Request) {
+		ctx := c.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if err := limit.Acquire(ctx); err != nil {
+			r.Abort()
+		}
+	})
+	c.OnResponse(func(r *colly.Response) {
+		limit.Observe(len(r.Body))
+		limit.Release()
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		limit.Failure(spiderError(r, err))
+		limit.Release()
+	})
+}
+
+// spiderError returns the status of a failed colly response as a
+// *common.HTTPStatusError, keeping Retry-After
+func spiderError(r *colly.Response, err error) error {
+	if r.StatusCode == 0 || r.Request == nil {
+		return err
+	}
+	header := http.Header{}
+	if r.Headers != nil {
+		header = *r.Headers
+	}
+	return common.NewHTTPStatusError(&http.Response{
+		StatusCode: r.StatusCode,
+		Status:     fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		Header:     header,
+		Request:    &http.Request{URL: r.Request.URL},
+	})
+}
+
+// transferReader paces r with the bandwidth limit and reports its
+// throughput to the adaptive pool limit
+func (s *Session) transferReader(ctx context.Context, r io.Reader) io.Reader {
+	return s.poolLimit().Reader(s.limiter().Reader(ctx, r))
+}
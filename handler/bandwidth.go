@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Fromsko/downhub/common"
+)
+
+// limiter returns the bandwidth limiter shared by every transfer of the
+// session, nil when download.max_bandwidth and download.bandwidth_schedule
+// are unset
+func (s *Session) limiter() *common.Limiter {
+	if s.parent != nil {
+		return s.parent.limiter()
+	}
+	s.limOnce.Do(func() {
+		if s.Config == nil || s.Config.Download.MaxBandwidth == "" && len(s.Config.Download.BandwidthSchedule) == 0 {
+			return
+		}
+		rate, err := common.BandwidthFor(s.Config)
+		if err != nil {
+			s.Log.Error("带宽限制配置无效, 不限速: %v", err)
+			return
+		}
+		var last atomic.Int64
+		last.Store(-1)
+		s.lim = common.NewLimiter(func(now time.Time) int64 {
+			r := rate(now)
+			if last.Swap(r) != r {
+				s.Log.Info("带宽限制: %s", common.FormatBandwidth(r))
+			}
+			return r
+		})
+	})
+	return s.lim
+}
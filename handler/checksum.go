@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const quarantineDir = ".quarantine"
+
+// validateChecksums reports whether advanced.validate_checksums is on
+func (s *Session) validateChecksums() bool {
+	return s.Config != nil && s.Config.Advanced.ValidateChecksums
+}
+
+// newHash returns the streaming hash for a download, nil when disabled
+func (s *Session) newHash() hash.Hash {
+	if !s.validateChecksums() {
+		return nil
+	}
+	return sha256.New()
+}
+
+// hashFile feeds the current content of path into h
+func hashFile(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// isChecksumFile reports whether an asset publishes SHA-256 checksums
+func isChecksumFile(name string) bool {
+	lower := strings.ToLower(name)
+	return lower == "sha256sums" || lower == "sha256sums.txt" ||
+		strings.HasSuffix(lower, ".sha256") ||
+		strings.HasSuffix(lower, "checksums.txt")
+}
+
+// parseChecksumFile reads `<hex>  <name>` lines (the sha256sum format); a
+// `<name>.sha256` file may also hold a bare digest for <name>
+func parseChecksumFile(path string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+			continue
+		}
+		digest := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(digest); err != nil {
+			continue
+		}
+		if len(fields) >= 2 {
+			sums[filepath.Base(strings.TrimPrefix(fields[1], "*"))] = digest
+		} else if strings.HasSuffix(strings.ToLower(path), ".sha256") {
+			sums[strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))] = digest
+		}
+	}
+	return sums
+}
+
+// verifyChecksums checks every hashed download against the checksum files
+// downloaded next to it, quarantining mismatches. It returns the paths
+// that failed verification.
+func (s *Session) verifyChecksums(digests map[string]string) []string {
+	expected := make(map[string]map[string]string)
+	for path := range digests {
+		if !isChecksumFile(filepath.Base(path)) {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if expected[dir] == nil {
+			expected[dir] = make(map[string]string)
+		}
+		for name, digest := range parseChecksumFile(path) {
+			expected[dir][name] = digest
+		}
+	}
+
+	var bad []string
+	for path, digest := range digests {
+		want, ok := expected[filepath.Dir(path)][filepath.Base(path)]
+		if !ok {
+			continue
+		}
+		if want != digest {
+			s.Log.Error("校验失败: %s, 期望 %s, 实际 %s", path, want, digest)
+			s.quarantine(path)
+			bad = append(bad, path)
+		}
+	}
+	return bad
+}
+
+// quarantine moves a file that failed verification out of the way
+func (s *Session) quarantine(path string) {
+	dir := filepath.Join(filepath.Dir(path), quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.Log.Error("Create directory error! %v", err)
+		return
+	}
+	if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+		s.Log.Error("Quarantine %s: %v", path, err)
+	}
+}
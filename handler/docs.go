@@ -1,27 +1,52 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/Fromsko/downhub/common"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/storage/memory"
 )
 
+type (
+	// DocsOptions configures a docs download
+	DocsOptions struct {
+		// Dir is the base directory, files go to Dir/owner/repo
+		Dir string
+		// DocsPath is the docs directory of the repository
+		DocsPath string
+		// Proxy of the clone, see DownloadOptions.Proxy
+		Proxy string
+	}
+	// DocsResult summarizes the docs exported from a repository
+	DocsResult struct {
+		Repo    string       `json:"repo"`
+		URL     string       `json:"url"`
+		Commit  string       `json:"commit"`
+		Dir     string       `json:"dir"`
+		Total   int          `json:"total"`
+		Success int          `json:"success"`
+		Failed  int          `json:"failed"`
+		Files   []FileResult `json:"files"`
+	}
+)
+
 // shouldIncludeFile checks if a file should be included based on the configuration
-func shouldIncludeFile(filename string, docsPath string) bool {
-	// Use the global cfg variable from handler.go
+func (s *Session) shouldIncludeFile(filename string, docsPath string) bool {
 	// If file filters are configured, use them
-	if cfg != nil && len(cfg.FileFilters.Include) > 0 {
+	if s.Config != nil && len(s.Config.FileFilters.Include) > 0 {
 		// Check include patterns
 		included := false
-		for _, pattern := range cfg.FileFilters.Include {
+		for _, pattern := range s.Config.FileFilters.Include {
 			matched, err := filepath.Match(pattern, filename)
 			if err == nil && matched {
 				included = true
@@ -40,7 +65,7 @@ func shouldIncludeFile(filename string, docsPath string) bool {
 		}
 
 		// Check exclude patterns
-		for _, pattern := range cfg.FileFilters.Exclude {
+		for _, pattern := range s.Config.FileFilters.Exclude {
 			matched, err := filepath.Match(pattern, filename)
 			if err == nil && matched {
 				return false
@@ -56,187 +81,178 @@ func shouldIncludeFile(filename string, docsPath string) bool {
 
 	// Default behavior: check if file is in docs path or is txt/md file
 	return (docsPath != "" && (strings.HasPrefix(filename, docsPath+"/") || filename == docsPath)) ||
-		   (strings.HasSuffix(filename, ".txt") || strings.HasSuffix(filename, ".md"))
+		(strings.HasSuffix(filename, ".txt") || strings.HasSuffix(filename, ".md"))
 }
 
-// DownloadDocs downloads txt and md files from a GitHub repository
-func DownloadDocs(repoURL, outputDir, docsPath, proxy string) {
-	fmt.Printf("Cloning repository: %s\n", repoURL)
-
-	// Extract owner and repo name from URL for directory structure
-	var owner, repo string
-	if strings.Contains(repoURL, "github.com/") {
-		parts := strings.Split(repoURL, "github.com/")
-		if len(parts) > 1 {
-			repoParts := strings.Split(parts[1], "/")
-			if len(repoParts) >= 2 {
-				owner = repoParts[0]
-				repo = repoParts[1]
-			}
-		}
-	}
+// DownloadDocs downloads docs with the package configuration
+func DownloadDocs(ctx context.Context, repoURL string, opts DocsOptions) (*DocsResult, error) {
+	return defaultSession().DownloadDocs(ctx, repoURL, opts)
+}
 
+// DownloadDocs exports the txt and md files of the default branch of a
+// repository to opts.Dir/owner/repo. The result is returned even when some
+// files failed, in which case err reports how many.
+func (s *Session) DownloadDocs(ctx context.Context, repoURL string, opts DocsOptions) (*DocsResult, error) {
+	owner, repo := common.ParseRepo(repoURL)
+	result := &DocsResult{Repo: owner + "/" + repo, URL: repoURL, Dir: opts.Dir}
 	// If we have owner and repo, create subdirectory structure
 	if owner != "" && repo != "" {
-		outputDir = filepath.Join(outputDir, owner, repo)
-	}
-
-	// Clone the repository into memory
-	r, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
-		URL: repoURL,
-	})
-	if err != nil {
-		fmt.Printf("Error cloning repository: %v\n", err)
-		return
+		result.Dir = filepath.Join(opts.Dir, owner, repo)
 	}
 
-	// Get the HEAD reference
-	ref, err := r.Head()
+	proxy := s.proxy(opts.Proxy)
+	s.Log.Info("Cloning repository: %s", repoURL)
+	commit, filePaths, fetch, err := s.cloneDocs(ctx, repoURL, result.Dir, opts.DocsPath, proxy)
 	if err != nil {
-		fmt.Printf("Error getting HEAD reference: %v\n", err)
-		return
-	}
-
-	// Get the commit object
-	commit, err := r.CommitObject(ref.Hash())
-	if err != nil {
-		fmt.Printf("Error getting commit object: %v\n", err)
-		return
-	}
-
-	// Get the tree object
-	tree, err := commit.Tree()
-	if err != nil {
-		fmt.Printf("Error getting tree object: %v\n", err)
-		return
-	}
-
-	// Walk the tree to find txt and md files
-	var filesToDownload []string
-	var filePaths []string
-
-	// First, try to find files in the specified docs path
-	err = tree.Files().ForEach(func(f *object.File) error {
-		// Check if file should be included based on configuration
-		if shouldIncludeFile(f.Name, docsPath) {
-			filesToDownload = append(filesToDownload, f.Name)
-			filePaths = append(filePaths, f.Name)
+		if ctx.Err() != nil || owner == "" || repo == "" {
+			return result, err
+		}
+		// Fall back to fetching the files one by one as raw files
+		s.Log.Warn("克隆失败, 改为逐个下载 raw 文件: %s, %v", repoURL, err)
+		var rawErr error
+		commit, filePaths, fetch, rawErr = s.rawDocs(ctx, owner, repo, result.Dir, opts.DocsPath, proxy)
+		if rawErr != nil {
+			return result, fmt.Errorf("%w; raw: %v", err, rawErr)
 		}
-		return nil
-	})
-
-	if err != nil {
-		fmt.Printf("Error walking tree: %v\n", err)
-		return
 	}
+	result.Commit = commit
 
-	if len(filesToDownload) == 0 {
-		fmt.Println("No txt or md files found in repository")
-		return
+	var errs []error
+	result.Total = len(filePaths)
+	if result.Total == 0 {
+		s.Log.Info("No txt or md files found in repository")
+		return result, nil
 	}
+	s.Log.Info("Found %d files to download", result.Total)
 
-	fmt.Printf("Found %d files to download\n", len(filesToDownload))
-
-	// Download each file
-	for i, filePath := range filePaths {
-		err := downloadFileFromRepo(tree, filePath, outputDir, filesToDownload[i])
+	for _, filePath := range filePaths {
+		if err := ctx.Err(); err != nil {
+			s.Log.Warn("文档下载已中断，已完成 %d / %d 个文件: %s", result.Success, result.Total, result.Dir)
+			return result, fmt.Errorf("%s: %w", result.Repo, err)
+		}
+		started := time.Now()
+		path := filepath.Join(result.Dir, filePath)
+		err := fetch(filePath)
+		s.recordDocFile(repoURL, result.Commit, filePath, path, started, err)
+		result.Files = append(result.Files, FileResult{URL: docURL(repoURL, result.Commit, filePath), Path: path, Error: err})
 		if err != nil {
-			fmt.Printf("Error downloading %s: %v\n", filePath, err)
+			result.Failed++
+			errs = append(errs, err)
+			s.Log.Error("Error downloading %s: %v", filePath, err)
 		} else {
-			fmt.Printf("Downloaded: %s\n", filePath)
+			result.Success++
+			s.Log.Info("Downloaded: %s", filePath)
 		}
 	}
 
-	fmt.Printf("Download completed. Files saved to: %s\n", outputDir)
-}
-
-// DownloadDocsToDataDir downloads txt and md files from a GitHub repository to the data directory structure
-func DownloadDocsToDataDir(repoURL, docsPath, proxy, docsBaseDir string) {
-	// Extract owner and repo name from URL
-	// e.g., https://github.com/gin-gonic/gin -> gin-gonic/gin
-	var owner, repo string
-	if strings.Contains(repoURL, "github.com/") {
-		parts := strings.Split(repoURL, "github.com/")
-		if len(parts) > 1 {
-			repoParts := strings.Split(parts[1], "/")
-			if len(repoParts) >= 2 {
-				owner = repoParts[0]
-				repo = repoParts[1]
-			}
-		}
+	s.Log.Info("Download completed. Files saved to: %s", result.Dir)
+	if result.Failed > 0 {
+		return result, &common.BatchError{Name: result.Repo, Unit: "docs", Failed: result.Failed, Total: result.Total, Errs: errs}
 	}
+	return result, nil
+}
 
-	// Create output directory with owner/repo structure
-	outputDir := filepath.Join(docsBaseDir, owner, repo)
-	fmt.Printf("Cloning repository: %s\n", repoURL)
-
+// cloneDocs clones the repository and returns the commit of its default
+// branch, the files to export and how to write one of them under dir
+func (s *Session) cloneDocs(ctx context.Context, repoURL, dir, docsPath, proxy string) (string, []string, func(string) error, error) {
 	// Clone the repository into memory
-	r, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
-		URL: repoURL,
-	})
+	r, err := s.cloneRepo(ctx, repoURL, proxy)
 	if err != nil {
-		fmt.Printf("Error cloning repository: %v\n", err)
-		return
+		return "", nil, nil, fmt.Errorf("clone %s: %w", repoURL, err)
 	}
 
 	// Get the HEAD reference
 	ref, err := r.Head()
 	if err != nil {
-		fmt.Printf("Error getting HEAD reference: %v\n", err)
-		return
+		return "", nil, nil, fmt.Errorf("get HEAD reference: %w", err)
 	}
 
 	// Get the commit object
 	commit, err := r.CommitObject(ref.Hash())
 	if err != nil {
-		fmt.Printf("Error getting commit object: %v\n", err)
-		return
+		return "", nil, nil, fmt.Errorf("get commit object: %w", err)
 	}
 
 	// Get the tree object
 	tree, err := commit.Tree()
 	if err != nil {
-		fmt.Printf("Error getting tree object: %v\n", err)
-		return
+		return "", nil, nil, fmt.Errorf("get tree object: %w", err)
 	}
 
-	// Walk the tree to find txt and md files
-	var filesToDownload []string
+	// Walk the tree to find the files to export
 	var filePaths []string
-
-	// First, try to find files in the specified docs path
 	err = tree.Files().ForEach(func(f *object.File) error {
 		// Check if file should be included based on configuration
-		if shouldIncludeFile(f.Name, docsPath) {
-			filesToDownload = append(filesToDownload, f.Name)
+		if s.shouldIncludeFile(f.Name, docsPath) {
 			filePaths = append(filePaths, f.Name)
 		}
 		return nil
 	})
-
 	if err != nil {
-		fmt.Printf("Error walking tree: %v\n", err)
-		return
+		return "", nil, nil, fmt.Errorf("walk tree: %w", err)
 	}
 
-	if len(filesToDownload) == 0 {
-		fmt.Println("No txt or md files found in repository")
-		return
+	fetch := func(filePath string) error {
+		return downloadFileFromRepo(tree, filePath, dir, filePath)
 	}
+	return commit.Hash.String(), filePaths, fetch, nil
+}
 
-	fmt.Printf("Found %d files to download\n", len(filesToDownload))
+// rawDocs lists the files of the default branch through the GitHub API
+// and returns a fetch that downloads one of them as a raw file under dir
+func (s *Session) rawDocs(ctx context.Context, owner, repo, dir, docsPath, proxy string) (string, []string, func(string) error, error) {
+	client, err := s.httpClient(proxy)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	gh := common.NewGitHubClientFor(s.Config, client)
+	gh.Log = s.Log
+	commit, files, err := gh.Files(ctx, owner, repo, "HEAD")
+	if err != nil {
+		return "", nil, nil, err
+	}
 
-	// Download each file
-	for i, filePath := range filePaths {
-		err := downloadFileFromRepo(tree, filePath, outputDir, filesToDownload[i])
-		if err != nil {
-			fmt.Printf("Error downloading %s: %v\n", filePath, err)
-		} else {
-			fmt.Printf("Downloaded: %s\n", filePath)
+	var filePaths []string
+	for _, name := range files {
+		if s.shouldIncludeFile(name, docsPath) {
+			filePaths = append(filePaths, name)
 		}
 	}
 
-	fmt.Printf("Download completed. Files saved to: %s\n", outputDir)
+	fetch := func(filePath string) error {
+		outputPath := filepath.Join(dir, filePath)
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return fmt.Errorf("error creating directory %s: %v", filepath.Dir(outputPath), err)
+		}
+		return s.downloadFileOverHTTP(ctx, common.RawURL(owner, repo, commit, filePath), outputPath, proxy)
+	}
+	return commit, filePaths, fetch, nil
+}
+
+// cloneRepo clones the repository into memory through proxy, retrying
+// transient failures, from each configured mirror in turn and then from
+// the origin
+func (s *Session) cloneRepo(ctx context.Context, repoURL, proxy string) (*git.Repository, error) {
+	gitCtx, err := s.gitContext(ctx, proxy)
+	if err != nil {
+		return nil, err
+	}
+	var r *git.Repository
+	sources := common.MirrorURLs(s.Config, common.KindClone, repoURL)
+	for i, source := range sources {
+		err = common.Retry(ctx, s.retryPolicy(), s.retryLogger(source.URL), func(int) error {
+			var err error
+			r, err = git.CloneContext(gitCtx, memory.NewStorage(), nil, &git.CloneOptions{
+				URL: source.URL,
+			})
+			return err
+		})
+		if err == nil || ctx.Err() != nil || i == len(sources)-1 {
+			break
+		}
+		s.Log.Warn("%s 克隆失败, 改用%s: %v", source.Source(), sources[i+1].Source(), err)
+	}
+	return r, err
 }
 
 // downloadFileFromRepo downloads a file from the repository tree
@@ -277,44 +293,59 @@ func downloadFileFromRepo(tree *object.Tree, filePath, outputDir, savePath strin
 	return nil
 }
 
-// downloadFileOverHTTP downloads a file over HTTP with optional proxy
-func downloadFileOverHTTP(fileURL, outputPath, proxy string) error {
-	var client *http.Client
+// downloadFileOverHTTP downloads a raw file over HTTP with optional proxy,
+// from each configured mirror in turn and then from the origin
+func (s *Session) downloadFileOverHTTP(ctx context.Context, fileURL, outputPath, proxy string) error {
+	client, err := s.downloadClient(proxy)
+	if err != nil {
+		return err
+	}
 
-	if proxy != "" {
-		proxyURL, err := url.Parse(proxy)
-		if err != nil {
-			return fmt.Errorf("invalid proxy URL: %v", err)
-		}
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
-			},
+	sources := common.MirrorURLs(s.Config, common.KindRaw, fileURL)
+	for i, source := range sources {
+		err = common.Retry(ctx, s.retryPolicy(), s.retryLogger(source.URL), func(int) error {
+			return s.fetchRaw(ctx, client, source.URL, outputPath)
+		})
+		if err == nil || ctx.Err() != nil || i == len(sources)-1 {
+			break
 		}
-	} else {
-		client = &http.Client{}
+		s.Log.Warn("%s 下载失败, 改用%s: %s, %v", source.Source(), sources[i+1].Source(), fileURL, err)
 	}
+	return err
+}
 
-	resp, err := client.Get(fileURL)
+// fetchRaw performs a single download attempt of fileURL into outputPath,
+// writing to a part file that only replaces outputPath once complete
+func (s *Session) fetchRaw(ctx context.Context, client *http.Client, fileURL, outputPath string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error downloading file: %v", err)
+		return fmt.Errorf("error downloading file: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP error %d: %s", resp.StatusCode, resp.Status)
+		return common.NewHTTPStatusError(resp)
 	}
 
-	outFile, err := os.Create(outputPath)
+	partPath := outputPath + partSuffix
+	outFile, err := os.Create(partPath)
 	if err != nil {
 		return fmt.Errorf("error creating file: %v", err)
 	}
-	defer outFile.Close()
-
-	_, err = io.Copy(outFile, resp.Body)
+	written, err := io.Copy(outFile, s.transferReader(ctx, resp.Body))
+	if cerr := outFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && resp.ContentLength > 0 && written != resp.ContentLength {
+		err = fmt.Errorf("short body for %s: %w", fileURL, io.ErrUnexpectedEOF)
+	}
 	if err != nil {
-		return fmt.Errorf("error writing file: %v", err)
+		os.Remove(partPath)
+		return fmt.Errorf("error writing file: %w", err)
 	}
-
-	return nil
+	return os.Rename(partPath, outputPath)
 }
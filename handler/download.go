@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Fromsko/downhub/catalog"
+	"github.com/Fromsko/downhub/common"
+)
+
+// httpClient returns the injected client, or a client over the session
+// transports for proxy
+func (s *Session) httpClient(proxy string) (*http.Client, error) {
+	if s.HTTP != nil {
+		return s.HTTP, nil
+	}
+	return s.Transports.Client(proxy)
+}
+
+// downloadClient returns httpClient(proxy) with the requests of each host
+// capped by download.host_limits and download.max_per_host
+func (s *Session) downloadClient(proxy string) (*http.Client, error) {
+	client, err := s.httpClient(proxy)
+	if err != nil {
+		return nil, err
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	capped := *client
+	capped.Transport = s.hostSlots().Transport(rt)
+	return &capped, nil
+}
+
+// proxy returns the proxy of a download: explicit when set, otherwise the
+// environment or defaults.proxy, see common.ConfiguredProxy
+func (s *Session) proxy(explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	return common.ConfiguredProxy(s.Config)
+}
+
+// gitContext returns ctx carrying the round tripper go-git sends its
+// requests through: the one of httpClient, paced by the bandwidth limiter.
+// ctx is returned as is unless GitTransport is set.
+func (s *Session) gitContext(ctx context.Context, proxy string) (context.Context, error) {
+	if !s.GitTransport {
+		return ctx, nil
+	}
+	common.InstallGitTransport()
+	client, err := s.httpClient(proxy)
+	if err != nil {
+		return nil, err
+	}
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return common.WithRoundTripper(ctx, s.limiter().Transport(rt)), nil
+}
+
+// downloadResult describes a finished download
+type downloadResult struct {
+	Digest       string
+	ETag         string
+	LastModified string
+	Skipped      bool
+}
+
+// errNotModified is returned by fetchFile when the server answers 304
+var errNotModified = errors.New("not modified")
+
+// downFile downloads job.url into job.dir. Unless hub.Force is set, a file
+// already on disk is skipped when it matches the catalog, or revalidated
+// with a conditional request when it does not and its size and digest
+// are not known to be wrong. The file is fetched down
+// the routes of fetchRoutes, falling back to the next one when a route
+// fails or serves a file of the wrong size or digest. The SHA-256
+// digest is returned when advanced.validate_checksums is on or the release
+// published one.
+func (s *Session) downFile(ctx context.Context, hub *common.DownHub, job downloadJob, bar FileProgress) (downloadResult, error) {
+	var result downloadResult
+	tokens := strings.Split(job.url, "/")
+	fileName := tokens[len(tokens)-1]
+	path := filepath.Join(job.dir, fileName)
+
+	if err := os.MkdirAll(job.dir, 0755); err != nil {
+		bar.Done(err)
+		return result, err
+	}
+
+	var cond *conditional
+	if !hub.Force {
+		if info, err := os.Stat(path); err == nil {
+			record, _ := s.lookup(path)
+			if s.matchesRecord(path, info, record) {
+				bar.Skip(info.Size())
+				return downloadResult{Digest: record.SHA256, ETag: record.ETag, LastModified: record.LastModified, Skipped: true}, nil
+			}
+			if job.intact(path, info, record) {
+				cond = &conditional{ETag: record.ETag, ModTime: info.ModTime(), Size: info.Size()}
+			} else {
+				// A 304 would keep a truncated or corrupt file
+				s.Log.Warn("本地文件不完整或已损坏, 重新下载: %s", fileName)
+			}
+		}
+	}
+
+	h := s.newHash()
+	if h == nil && job.sha256 != "" {
+		h = sha256.New()
+	}
+	var meta *partMeta
+	notify := s.retryLogger(fileName)
+	var err error
+	routes := s.fetchRoutes(ctx, job.kind, job.url, hub.ProxyUrl)
+	for i, route := range routes {
+		var httpClient *http.Client
+		if httpClient, err = s.downloadClient(route.proxy); err != nil {
+			break
+		}
+		err = common.Retry(ctx, s.retryPolicy(), func(attempt int, err error, wait time.Duration) {
+			notify(attempt, err, wait)
+			bar.Retry(attempt)
+		}, func(int) error {
+			var err error
+			meta, err = s.fetchFile(ctx, httpClient, route.source.URL, path, bar, h, cond)
+			// Every failed attempt may be a sign of overload
+			s.poolLimit().Failure(err)
+			return err
+		})
+		if err == nil {
+			err = job.check(path, h)
+		}
+		if err == nil || errors.Is(err, errNotModified) || ctx.Err() != nil || i == len(routes)-1 {
+			break
+		}
+		if errors.Is(err, common.ErrChecksum) {
+			os.Remove(path)
+		}
+		s.Log.Warn("%s 下载失败, 改用%s: %s, %v", route, routes[i+1], fileName, err)
+	}
+	if errors.Is(err, errNotModified) {
+		err = nil
+		if h != nil {
+			h.Reset()
+			if err = hashFile(h, path); err == nil {
+				result.Digest = hex.EncodeToString(h.Sum(nil))
+			}
+		}
+		if err == nil {
+			err = job.check(path, h)
+		}
+		if err == nil {
+			bar.Skip(cond.Size)
+			result.Skipped = true
+			result.ETag = cond.ETag
+			return result, nil
+		}
+		result.Digest = ""
+	}
+	bar.Done(err)
+	if errors.Is(err, common.ErrChecksum) {
+		s.quarantine(path)
+	}
+	if err != nil {
+		return result, err
+	}
+	if meta != nil {
+		result.ETag = meta.ETag
+		result.LastModified = meta.LastModified
+	}
+	if h != nil {
+		result.Digest = hex.EncodeToString(h.Sum(nil))
+	}
+	return result, nil
+}
+
+// check compares the downloaded file with the size and digest published
+// for the job, h holding its digest
+func (job downloadJob) check(path string, h hash.Hash) error {
+	if job.size > 0 {
+		if info, err := os.Stat(path); err == nil && info.Size() != job.size {
+			return fmt.Errorf("%w: %s is %d bytes, expected %d", common.ErrChecksum, filepath.Base(path), info.Size(), job.size)
+		}
+	}
+	if job.sha256 != "" && h != nil {
+		if digest := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(digest, job.sha256) {
+			return fmt.Errorf("%w: %s has SHA-256 %s, expected %s", common.ErrChecksum, filepath.Base(path), digest, job.sha256)
+		}
+	}
+	return nil
+}
+
+// intact reports whether the file on disk may be revalidated rather than
+// fetched again: its size matches the published one and the catalog
+// record of a finished download, and its digest the published one
+func (job downloadJob) intact(path string, info os.FileInfo, record catalog.Record) bool {
+	if job.size > 0 && info.Size() != job.size {
+		return false
+	}
+	if record.Status == catalog.StatusDownloaded && record.Size > 0 && record.Size != info.Size() {
+		return false
+	}
+	if job.sha256 == "" {
+		return true
+	}
+	h := sha256.New()
+	return hashFile(h, path) == nil && job.check(path, h) == nil
+}
+
+// conditional holds the validators of a file already on disk
+type conditional struct {
+	ETag    string
+	ModTime time.Time
+	Size    int64
+}
+
+// matchesRecord reports whether the local file is the one the catalog
+// recorded as downloaded: same size and, when checksums are validated,
+// same SHA-256
+func (s *Session) matchesRecord(path string, info os.FileInfo, record catalog.Record) bool {
+	if record.Status != catalog.StatusDownloaded || record.Size != info.Size() {
+		return false
+	}
+	if record.SHA256 == "" || !s.validateChecksums() {
+		return true
+	}
+	h := sha256.New()
+	if err := hashFile(h, path); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == record.SHA256
+}
+
+// fetchFile performs a single download attempt of fetchUrl into path. Data
+// is written to path.part and resumed with Range/If-Range when a previous
+// attempt left one behind; the file is renamed into place once complete.
+// A non-nil h receives every byte of the file, including resumed ones.
+// A non-nil cond revalidates an existing file; errNotModified is returned
+// when the server confirms it is current. Large files served with
+// Accept-Ranges are fetched in segments, see fetchSegments.
+func (s *Session) fetchFile(ctx context.Context, httpClient *http.Client, fetchUrl, path string, bar FileProgress, h hash.Hash, cond *conditional) (*partMeta, error) {
+	offset, meta := resumeOffset(path, fetchUrl)
+	if offset == 0 && meta != nil {
+		return meta, s.fetchSegments(ctx, httpClient, fetchUrl, path, bar, h, meta, nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fetchUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", meta.validator())
+	} else if cond != nil {
+		if cond.ETag != "" {
+			req.Header.Set("If-None-Match", cond.ETag)
+		}
+		req.Header.Set("If-Modified-Since", cond.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && offset == 0 && cond != nil {
+		return nil, errNotModified
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			removePart(path)
+			return nil, fmt.Errorf("resume %s: bad range response, restarting: %w", fetchUrl, common.ErrRetryable)
+		}
+		flags |= os.O_APPEND
+		s.Log.Info("断点续传: %s, 从 %d 字节继续", filepath.Base(path), offset)
+	case http.StatusOK:
+		// Range ignored or the file changed upstream: start over
+		if offset > 0 {
+			s.Log.Warn("服务器不支持续传或文件已变更, 重新下载: %s", filepath.Base(path))
+		}
+		offset = 0
+		flags |= os.O_TRUNC
+		meta = newPartMeta(fetchUrl, resp)
+		if n := s.segmentCount(resp, meta); n > 1 {
+			meta.Segments = splitSegments(meta.Size, n)
+			return meta, s.fetchSegments(ctx, httpClient, fetchUrl, path, bar, h, meta, resp.Body)
+		}
+		if err := savePartMeta(path, meta); err != nil {
+			return nil, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		removePart(path)
+		return nil, fmt.Errorf("resume %s: %s, restarting: %w", fetchUrl, resp.Status, common.ErrRetryable)
+	default:
+		return nil, common.NewHTTPStatusError(resp)
+	}
+
+	out, err := os.OpenFile(path+partSuffix, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var w io.Writer = out
+	if h != nil {
+		h.Reset()
+		if offset > 0 {
+			if err := hashFile(h, path+partSuffix); err != nil {
+				out.Close()
+				return nil, err
+			}
+		}
+		w = io.MultiWriter(out, h)
+	}
+
+	if resp.ContentLength > 0 {
+		bar.SetTotal(offset + resp.ContentLength)
+	}
+	bar.SetCurrent(offset)
+	written, err := io.Copy(w, bar.ProxyReader(s.transferReader(ctx, resp.Body)))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > 0 && written != resp.ContentLength {
+		return nil, fmt.Errorf("short body for %s: %w", fetchUrl, io.ErrUnexpectedEOF)
+	}
+
+	if err := os.Rename(path+partSuffix, path); err != nil {
+		return nil, err
+	}
+	os.Remove(path + metaSuffix)
+	return meta, nil
+}
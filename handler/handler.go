@@ -1,11 +1,9 @@
 package handler
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -17,8 +15,6 @@ import (
 	"github.com/Fromsko/downhub/config"
 
 	"github.com/gocolly/colly/v2"
-	"github.com/vbauerster/mpb/v8"
-	"github.com/vbauerster/mpb/v8/decor"
 )
 
 const DefaultProxy = "http://localhost:7890"
@@ -56,7 +52,16 @@ func ReadFromFile(file string) (urlList []string) {
 	return
 }
 
-func Repo(hub *common.DownHub) {
+// Repo discovers the tags of the hub repository and collects the archives
+// and assets to download
+func Repo(ctx context.Context, hub *common.DownHub) error {
+	return defaultSession().collect(ctx, hub)
+}
+
+// collect discovers and selects the tags of the hub repository and
+// collects the archives and assets to download
+func (s *Session) collect(ctx context.Context, hub *common.DownHub) error {
+	hub.Spider.Context = ctx
 
 	matchRegex := regexp.MustCompile(hub.Link())
 	// Only create directory if DownDir is not set
@@ -65,13 +70,63 @@ func Repo(hub *common.DownHub) {
 		hub.DownDir = filepath.Join(hub.DownDir, hub.RepoName)
 	}
 	if err := os.MkdirAll(hub.DownDir, 0755); err != nil {
-		common.Log.Error("Create directory error!", err)
+		return fmt.Errorf("create directory %s: %w", hub.DownDir, err)
+	}
+
+	if err := s.discoverTags(ctx, hub, matchRegex); err != nil {
+		return err
+	}
+	if err := s.selectTags(hub); err != nil {
+		return err
+	}
+	collectArchives(hub)
+	s.collectAssets(hub)
+	return nil
+}
+
+// discoverTags records the repository tags on the hub, trying the API (when
+// enabled), then ls-remote, then the HTML tags pages. The ls-remote error
+// is returned when scraping finds no tags either.
+func (s *Session) discoverTags(ctx context.Context, hub *common.DownHub, matchRegex *regexp.Regexp) error {
+	if s.Config != nil && s.Config.GitHub.UseAPI {
+		err := s.apiTags(ctx, hub)
+		if err == nil {
+			return nil
+		}
+		s.Log.Warn("GitHub API failed, falling back to ls-remote: %v", err)
 	}
 
+	err := s.listTags(ctx, hub)
+	if err == nil {
+		return nil
+	}
+	s.Log.Warn("ls-remote failed, falling back to tags page: %v", err)
+	s.scrapeTags(hub, matchRegex)
+	if len(hub.Tags) == 0 {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	return nil
+}
+
+// scrapeTags collects the tag archives by walking the HTML tags pages
+func (s *Session) scrapeTags(hub *common.DownHub, matchRegex *regexp.Regexp) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
 	hub.Spider.OnHTML("a.Link--muted[href]", func(e *colly.HTMLElement) {
-		if matchRegex.MatchString(e.Attr("href")) {
-			link := e.Request.AbsoluteURL(e.Attr("href"))
-			hub.Filter(link)
+		href := e.Attr("href")
+		if !matchRegex.MatchString(href) {
+			return
+		}
+		tag := href[strings.Index(href, "/archive/refs/tags/")+len("/archive/refs/tags/"):]
+		tag = strings.TrimSuffix(strings.TrimSuffix(tag, ".zip"), ".tar.gz")
+		mu.Lock()
+		defer mu.Unlock()
+		if !seen[tag] {
+			seen[tag] = true
+			hub.Tags = append(hub.Tags, common.Tag{Name: tag})
 		}
 	})
 
@@ -83,262 +138,89 @@ func Repo(hub *common.DownHub) {
 	hub.Spider.OnScraped(func(r *colly.Response) {
 		nxp := hub.BaseUrl + "/tags?after=" + hub.LastTag
 		if r.Request.URL.String() != nxp {
-			common.Log.Info("Next repo :> %s", nxp)
+			s.Log.Info("Next repo :> %s", nxp)
 			hub.Spider.Visit(nxp)
 		}
 	})
 
 	err := hub.Spider.Visit(hub.BaseUrl + "/tags")
 	if err != nil {
-		common.Log.Error("Visiting URL:", hub.BaseUrl+"/tags", "-", err)
+		s.Log.Error("Visiting URL: %s - %v", hub.BaseUrl+"/tags", err)
 	} else {
-		common.Log.Info("Visiting  :> %s", hub.BaseUrl+"/tags")
+		s.Log.Info("Visiting  :> %s", hub.BaseUrl+"/tags")
 	}
 
 	hub.Spider.Wait()
 
 	defer func() {
-		common.Log.Info("Finished tasks!")
+		s.Log.Info("Finished tasks!")
 	}()
 }
 
-func downFile(fetchUrl, dir string, bar *mpb.Bar, proxy string) error {
-	tokens := strings.Split(fetchUrl, "/")
-	fileName := tokens[len(tokens)-1]
-
-	out, err := os.Create(filepath.Join(dir, fileName))
-	if err != nil {
-		bar.Abort(false)
-		return err
-	}
-
-	var httpClient *http.Client
-	if proxy != "" {
-		proxyURL, err := url.Parse(proxy)
-		if err != nil {
-			bar.Abort(false)
-			return fmt.Errorf("invalid proxy URL: %v", err)
-		}
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(proxyURL),
-			},
-		}
-	} else {
-		httpClient = &http.Client{}
-	}
-
-	resp, err := httpClient.Get(fetchUrl)
-	if err != nil {
-		bar.Abort(false)
-		return fmt.Errorf("request failed: %v", err)
-	}
-	defer resp.Body.Close()
-	defer out.Close()
-
-	total := resp.ContentLength
-	if total > 0 {
-		bar.SetTotal(total, false)
-	}
-	reader := bar.ProxyReader(resp.Body)
-	_, err = io.Copy(out, reader)
-	if err != nil {
-		bar.Abort(false)
-		return err
-	}
-	bar.SetTotal(bar.Current(), true)
-	return nil
-}
-
-func saveResult(hub *common.DownHub) {
-	type save struct {
-		Name string           `json:"repo_name"`
-		Url  string           `json:"repo_url"`
-		Tags *common.DownType `json:"download_sources"`
-	}
-
-	f, _ := os.Create("output-" + hub.RepoName + ".json")
-
-	json.NewEncoder(f).Encode(save{
-		Name: hub.RepoName,
-		Url:  hub.BaseUrl,
-		Tags: hub.DownType,
-	})
-
-	defer f.Close()
-}
-
-func DownloadRepo(url string, proxy string, opts ...common.Option) {
-	// Use proxy from config if not provided
-	if proxy == "" && cfg != nil && cfg.Defaults.Proxy != "" {
-		proxy = cfg.Defaults.Proxy
-	}
-
-	hub := common.NewDownHub(common.WithBaseUrl(url), common.WithProxy(proxy), common.WithDefaultSpider())
-	for _, opt := range opts {
-		opt(hub)
-	}
-
-	Repo(hub)
-	total := len(hub.Zip) + len(hub.TarGz)
-	if total == 0 {
-		common.Log.Info("No files to download")
-		return
-	}
-
-	var success, failed int
-	var mu sync.Mutex
-	p := mpb.New(mpb.WithWidth(60))
-	wg := sync.WaitGroup{}
-
-	downloadFiles := func(fileList []string) {
-		for _, fileURL := range fileList {
-			wg.Add(1)
-			fileURL := fileURL
-			fileName := filepath.Base(fileURL)
-			bar := p.New(0,
-				mpb.BarStyle().Rbound("⠿").Filler("⠶").Tip("⠿").Padding(" "),
-				mpb.PrependDecorators(
-					decor.Name(fileName+" ", decor.WC{W: 30, C: decor.DSyncWidth}),
-				),
-				mpb.AppendDecorators(
-					decor.Percentage(decor.WC{W: 5}),
-					decor.CountersKibiByte("% .1f / % .1f"),
-				),
-			)
-			go func(url, dir, proxy string, bar *mpb.Bar) {
-				defer wg.Done()
-				err := downFile(url, dir, bar, proxy)
-				mu.Lock()
-				if err == nil {
-					success++
-				} else {
-					failed++
-					common.Log.Error("下载失败: %s, %v", url, err)
-				}
-				mu.Unlock()
-				saveResult(hub)
-			}(fileURL, hub.DownDir, hub.ProxyUrl, bar)
-		}
-	}
-	downloadFiles(hub.Zip)
-	downloadFiles(hub.TarGz)
-	wg.Wait()
-	p.Wait()
-	common.Log.Info("下载完成，总数: %d，成功: %d，失败: %d，存放目录: %s", total, success, failed, hub.DownDir)
-}
-
-// DownloadRepoToDataDir downloads a repository to the data directory structure
-func DownloadRepoToDataDir(url, proxy string) {
+// repoSourceDir returns the base_data_dir/source_dir/owner/repo directory of a repository
+func (s *Session) repoSourceDir(url string) string {
 	// Extract owner and repo name from URL
 	// e.g., https://github.com/gin-gonic/gin -> gin-gonic/gin
-	var owner, repo string
-	if strings.Contains(url, "github.com/") {
-		parts := strings.Split(url, "github.com/")
-		if len(parts) > 1 {
-			repoParts := strings.Split(parts[1], "/")
-			if len(repoParts) >= 2 {
-				owner = repoParts[0]
-				repo = repoParts[1]
-			}
-		}
-	}
-
-	// Use proxy from config if not provided
-	if proxy == "" && cfg != nil && cfg.Defaults.Proxy != "" {
-		proxy = cfg.Defaults.Proxy
-	}
+	owner, repo := common.ParseRepo(url)
 
-	// Set download directory to base_data_dir/source_dir/owner/repo structure
-	baseDataDir := cfg.Defaults.BaseDataDir
-	sourceDir := cfg.Defaults.SourceDir
-	if baseDataDir == "" {
-		baseDataDir = "data"
+	baseDataDir, sourceDir := "data", "source"
+	if c := s.Config; c != nil && c.Defaults.BaseDataDir != "" {
+		baseDataDir = c.Defaults.BaseDataDir
 	}
-	if sourceDir == "" {
-		sourceDir = "source"
+	if c := s.Config; c != nil && c.Defaults.SourceDir != "" {
+		sourceDir = c.Defaults.SourceDir
 	}
-	dataDir := filepath.Join(baseDataDir, sourceDir)
-	downloadDir := filepath.Join(dataDir, owner, repo)
-
-	hub := common.NewDownHub(common.WithBaseUrl(url), common.WithProxy(proxy), common.WithDefaultSpider())
-	hub.DownDir = downloadDir
+	return filepath.Join(baseDataDir, sourceDir, owner, repo)
+}
 
-	Repo(hub)
-	total := len(hub.Zip) + len(hub.TarGz)
-	if total == 0 {
-		common.Log.Info("No files to download")
-		return
+// repoOptions returns the hub options of the configured repository matching url
+func (s *Session) repoOptions(url string) []common.Option {
+	if s.Config == nil {
+		return nil
 	}
-
-	var success, failed int
-	var mu sync.Mutex
-	p := mpb.New(mpb.WithWidth(60))
-	wg := sync.WaitGroup{}
-
-	downloadFiles := func(fileList []string) {
-		for _, fileURL := range fileList {
-			wg.Add(1)
-			fileURL := fileURL
-			fileName := filepath.Base(fileURL)
-			bar := p.New(0,
-				mpb.BarStyle().Rbound("⠿").Filler("⠶").Tip("⠿").Padding(" "),
-				mpb.PrependDecorators(
-					decor.Name(fileName+" ", decor.WC{W: 30, C: decor.DSyncWidth}),
-				),
-				mpb.AppendDecorators(
-					decor.Percentage(decor.WC{W: 5}),
-					decor.CountersKibiByte("% .1f / % .1f"),
-				),
-			)
-			go func(url, dir, proxy string, bar *mpb.Bar) {
-				defer wg.Done()
-				err := downFile(url, dir, bar, proxy)
-				mu.Lock()
-				if err == nil {
-					success++
-				} else {
-					failed++
-					common.Log.Error("下载失败: %s, %v", url, err)
-				}
-				mu.Unlock()
-				saveResult(hub)
-			}(fileURL, hub.DownDir, hub.ProxyUrl, bar)
+	var opts []common.Option
+	for _, repo := range s.Config.Repositories {
+		if strings.TrimSuffix(repo.URL, "/") != strings.TrimSuffix(url, "/") {
+			continue
 		}
-	}
-	downloadFiles(hub.Zip)
-	downloadFiles(hub.TarGz)
-	wg.Wait()
-	p.Wait()
-	common.Log.Info("下载完成，总数: %d，成功: %d，失败: %d，存放目录: %s", total, success, failed, hub.DownDir)
-}
-
-func DownloadRepos(repos []string, proxy string) {
-	for _, repoUrl := range repos {
-		if repoUrl != "" {
-			DownloadRepo(repoUrl, proxy)
+		opts = append(opts, common.WithSelection(repo.Selection))
+		if repo.DownloadAssets {
+			opts = append(opts, common.WithAssets(repo.AssetInclude, repo.AssetExclude))
+			if !repo.DownloadSource {
+				opts = append(opts, common.WithoutSource())
+			}
 		}
+		break
 	}
+	return opts
 }
 
 // 检查能否访问 github.com
 func CheckGithubAccess(proxy string) bool {
+	return defaultSession().CheckGithubAccess(context.Background(), proxy)
+}
+
+// CheckGithubAccess reports whether github.com answers through proxy, or
+// through the injected client when one is set
+func (s *Session) CheckGithubAccess(ctx context.Context, proxy string) bool {
 	// Use timeout from config if available, otherwise default to 5 seconds
 	timeout := 5 * time.Second
-	if cfg != nil && cfg.Download.Timeout > 0 {
-		timeout = time.Duration(cfg.Download.Timeout) * time.Second
+	if s.Config != nil && s.Config.Download.Timeout > 0 {
+		timeout = time.Duration(s.Config.Download.Timeout) * time.Second
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	client := &http.Client{
-		Timeout: timeout,
+	client, err := s.httpClient(proxy)
+	if err != nil {
+		s.Log.Error("%v", err)
+		return false
 	}
-	if proxy != "" {
-		proxyURL, err := url.Parse(proxy)
-		if err == nil {
-			client.Transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
-		}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://github.com/", nil)
+	if err != nil {
+		return false
 	}
-	resp, err := client.Get("https://github.com/")
+	resp, err := client.Do(req)
 	if err != nil {
 		return false
 	}
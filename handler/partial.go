@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	partSuffix = ".part"
+	metaSuffix = ".part.json"
+)
+
+// partMeta is the sidecar of a .part file, holding the validators needed to
+// resume it with Range/If-Range
+type partMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	// Segments is the progress of a segmented download, whose .part file
+	// is allocated to Size up front
+	Segments []segment `json:"segments,omitempty"`
+}
+
+// validator returns the If-Range value, preferring a strong ETag
+func (m *partMeta) validator() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+func loadPartMeta(path string) *partMeta {
+	data, err := os.ReadFile(path + metaSuffix)
+	if err != nil {
+		return nil
+	}
+	meta := new(partMeta)
+	if json.Unmarshal(data, meta) != nil {
+		return nil
+	}
+	return meta
+}
+
+func savePartMeta(path string, meta *partMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+metaSuffix, data, 0644)
+}
+
+// removePart deletes the .part file of path and its sidecar
+func removePart(path string) {
+	os.Remove(path + partSuffix)
+	os.Remove(path + metaSuffix)
+}
+
+// resumeOffset returns how many bytes of path.part can be resumed for url,
+// discarding partial files that cannot be validated. The offset of a
+// segmented download is 0, its progress is in the segments of the meta.
+func resumeOffset(path, url string) (int64, *partMeta) {
+	info, err := os.Stat(path + partSuffix)
+	if err != nil {
+		return 0, nil
+	}
+	meta := loadPartMeta(path)
+	if meta == nil || meta.URL != url || meta.validator() == "" || info.Size() == 0 {
+		removePart(path)
+		return 0, nil
+	}
+	if len(meta.Segments) > 0 {
+		if info.Size() != meta.Size {
+			removePart(path)
+			return 0, nil
+		}
+		return 0, meta
+	}
+	return info.Size(), meta
+}
+
+// contentRangeStart parses the first byte position of a Content-Range header
+func contentRangeStart(header string) (int64, error) {
+	// bytes 100-199/200
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("unexpected Content-Range %q", header)
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, fmt.Errorf("unexpected Content-Range %q", header)
+	}
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// newPartMeta captures the validators of a fresh (200) response
+func newPartMeta(url string, resp *http.Response) *partMeta {
+	return &partMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         resp.ContentLength,
+	}
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fromsko/downhub/common"
+	"github.com/Fromsko/downhub/config"
+)
+
+type (
+	// DownloadOptions configures the download pipeline
+	DownloadOptions struct {
+		// Dir overrides base_data_dir/source_dir/owner/repo when set
+		Dir   string
+		Proxy string
+		// Selection refines the selection configured for the repository
+		Selection config.Selection
+		// Concurrency caps the parallel downloads of one repository within
+		// the session pool of max_concurrent_downloads, no extra cap when 0
+		Concurrency int
+		Force       bool
+		// Jobs is the number of repositories processed at once by
+		// DownloadRepos, 1 when 0
+		Jobs int
+		// Strict stops a batch at the first failed repository
+		Strict bool
+	}
+	// FileResult is the outcome of one downloaded file
+	FileResult struct {
+		URL     string `json:"url"`
+		Path    string `json:"path"`
+		Tag     string `json:"tag,omitempty"`
+		SHA256  string `json:"sha256,omitempty"`
+		Skipped bool   `json:"skipped,omitempty"`
+		Error   error  `json:"-"`
+	}
+	// RepoResult summarizes the download of one repository
+	RepoResult struct {
+		Repo     string       `json:"repo"`
+		URL      string       `json:"url"`
+		Dir      string       `json:"dir"`
+		Total    int          `json:"total"`
+		Success  int          `json:"success"`
+		Skipped  int          `json:"skipped"`
+		Failed   int          `json:"failed"`
+		Canceled int          `json:"canceled"`
+		Files    []FileResult `json:"files"`
+	}
+	// downloadJob is one file to fetch into dir
+	downloadJob struct {
+		url  string
+		dir  string
+		kind string
+		// size and sha256 are the published size and digest of the file,
+		// checked when known
+		size   int64
+		sha256 string
+	}
+)
+
+// newHub builds the hub of url from the configured repository and options
+func (s *Session) newHub(url string, opts DownloadOptions) *common.DownHub {
+	hubOpts := []common.Option{
+		common.WithConfig(s.Config), common.WithTransports(s.Transports),
+		common.WithBaseUrl(url), common.WithProxy(s.proxy(opts.Proxy)), common.WithDefaultSpider(),
+	}
+	hubOpts = append(hubOpts, s.repoOptions(url)...)
+	hubOpts = append(hubOpts, common.WithSelection(opts.Selection), common.WithForce(opts.Force))
+	hub := common.NewDownHub(hubOpts...)
+	if s.HTTP != nil {
+		hub.Spider.SetClient(s.HTTP)
+	}
+	s.throttleSpider(hub.Spider)
+
+	hub.DownDir = s.repoSourceDir(url)
+	if opts.Dir != "" {
+		hub.DownDir = opts.Dir
+	}
+	return hub
+}
+
+// DownloadRepo downloads a repository with the package configuration
+func DownloadRepo(ctx context.Context, url string, opts DownloadOptions) (*RepoResult, error) {
+	return defaultSession().DownloadRepo(ctx, url, opts)
+}
+
+// DownloadRepo discovers, selects and downloads the archives and assets of
+// a repository. The result is returned even when some files failed, in
+// which case err reports how many.
+func (s *Session) DownloadRepo(ctx context.Context, url string, opts DownloadOptions) (*RepoResult, error) {
+	hub := s.newHub(url, opts)
+	owner, repo := common.ParseRepo(url)
+	result := &RepoResult{Repo: owner + "/" + repo, URL: url, Dir: hub.DownDir}
+
+	if err := s.collect(ctx, hub); err != nil {
+		return result, err
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	var jobs []downloadJob
+	for _, fileURL := range append(hub.Zip, hub.TarGz...) {
+		jobs = append(jobs, downloadJob{url: fileURL, dir: hub.DownDir, kind: common.KindArchive})
+	}
+	for _, asset := range hub.Assets {
+		job := downloadJob{url: asset.URL, dir: filepath.Join(hub.DownDir, asset.Tag), kind: common.KindAsset, size: asset.Size}
+		if digest, ok := strings.CutPrefix(asset.Digest, "sha256:"); ok {
+			job.sha256 = digest
+		}
+		jobs = append(jobs, job)
+	}
+	result.Total = len(jobs)
+	if result.Total == 0 {
+		s.Log.Info("No files to download")
+		return result, nil
+	}
+
+	result.Files = s.runJobs(ctx, hub, jobs, opts.Concurrency)
+
+	digests := make(map[string]string)
+	for _, file := range result.Files {
+		if file.Error == nil && file.SHA256 != "" {
+			digests[file.Path] = file.SHA256
+		}
+	}
+	bad := make(map[string]bool)
+	if paths := s.verifyChecksums(digests); len(paths) > 0 {
+		s.recordQuarantined(paths)
+		for _, path := range paths {
+			bad[path] = true
+		}
+	}
+	var errs []error
+	for i, file := range result.Files {
+		if bad[file.Path] {
+			result.Files[i].Error = fmt.Errorf("%w: %s", common.ErrChecksum, file.Path)
+		}
+		switch {
+		case errors.Is(result.Files[i].Error, context.Canceled):
+			result.Canceled++
+		case result.Files[i].Error != nil:
+			result.Failed++
+			errs = append(errs, result.Files[i].Error)
+		case file.Skipped:
+			result.Skipped++
+		default:
+			result.Success++
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		s.Log.Warn("下载已中断，总数: %d，成功: %d，跳过: %d，失败: %d，未完成: %d，未完成的文件已保留为 %s 以便续传，存放目录: %s", result.Total, result.Success, result.Skipped, result.Failed, result.Canceled, partSuffix, hub.DownDir)
+		return result, fmt.Errorf("%s: %w", result.Repo, err)
+	}
+	s.Log.Info("下载完成，总数: %d，成功: %d，跳过: %d，失败: %d，存放目录: %s", result.Total, result.Success, result.Skipped, result.Failed, hub.DownDir)
+	if result.Failed > 0 {
+		return result, &common.BatchError{Name: result.Repo, Unit: "files", Failed: result.Failed, Total: result.Total, Errs: errs}
+	}
+	return result, ctx.Err()
+}
+
+// runJobs downloads jobs on the session scheduler, at most limit at once
+// when limit is positive
+func (s *Session) runJobs(ctx context.Context, hub *common.DownHub, jobs []downloadJob, limit int) []FileResult {
+	results := make([]FileResult, len(jobs))
+	owner, repo := common.ParseRepo(hub.BaseUrl)
+	p := s.progress(owner + "/" + repo)
+	group := s.scheduler().group(limit)
+
+	for i, job := range jobs {
+		group.submit(func() {
+			path := filepath.Join(job.dir, filepath.Base(job.url))
+			results[i] = FileResult{URL: job.url, Path: path, Tag: urlTag(job.url)}
+			if err := ctx.Err(); err != nil {
+				// Interrupted before the transfer started
+				results[i].Error = err
+				return
+			}
+			limit := s.poolLimit()
+			if err := limit.Acquire(ctx); err != nil {
+				results[i].Error = err
+				return
+			}
+			defer limit.Release()
+
+			bar := p.File(filepath.Base(job.url))
+			started := time.Now()
+			res, err := s.downFile(ctx, hub, job, bar)
+			switch {
+			case errors.Is(err, context.Canceled):
+				// The .part file stays behind for the next run to resume
+			case err != nil:
+				s.recordDownload(hub, job.url, path, res, started, err)
+				s.Log.Error("下载失败: %s, %v", job.url, err)
+			default:
+				s.recordDownload(hub, job.url, path, res, started, err)
+			}
+			results[i].SHA256 = res.Digest
+			results[i].Skipped = res.Skipped
+			results[i].Error = err
+		})
+	}
+	group.wait()
+	p.Wait()
+	return results
+}
+
+// DownloadRepos downloads repositories with the package configuration
+func DownloadRepos(ctx context.Context, urls []string, opts DownloadOptions) ([]*RepoResult, error) {
+	return defaultSession().DownloadRepos(ctx, urls, opts)
+}
+
+// DownloadRepos runs DownloadRepo for every non-empty URL, opts.Jobs at
+// a time, see EachRepo
+func (s *Session) DownloadRepos(ctx context.Context, urls []string, opts DownloadOptions) ([]*RepoResult, error) {
+	var repos []string
+	for _, url := range urls {
+		if url != "" {
+			repos = append(repos, url)
+		}
+	}
+	results := make([]*RepoResult, len(repos))
+	err := s.EachRepo(ctx, repos, opts.Jobs, opts.Strict, func(ctx context.Context, rs *Session, i int) error {
+		var err error
+		results[i], err = rs.DownloadRepo(ctx, repos[i], opts)
+		return err
+	})
+	// Drop the repositories a strict or interrupted run never started
+	started := results[:0]
+	for _, result := range results {
+		if result != nil {
+			started = append(started, result)
+		}
+	}
+	return started, err
+}
+
+// EachRepo runs task for every repository URL with the session of the package configuration
+func EachRepo(ctx context.Context, urls []string, jobs int, strict bool, task func(ctx context.Context, s *Session, i int) error) error {
+	return defaultSession().EachRepo(ctx, urls, jobs, strict, task)
+}
+
+// EachRepo runs task(i) for every urls[i], at most jobs at once. With more
+// than one job the session passed to task prefixes its log lines with
+// owner/repo. A failed repository does not stop the others, unless strict
+// is set: then no further repository is started. The returned
+// *common.BatchError holds the error of every failed repository.
+func (s *Session) EachRepo(ctx context.Context, urls []string, jobs int, strict bool, task func(ctx context.Context, s *Session, i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	var (
+		errs    = make([]error, len(urls))
+		sem     = make(chan struct{}, jobs)
+		wg      sync.WaitGroup
+		stop    atomic.Bool
+		started int
+	)
+loop:
+	for i, url := range urls {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		if stop.Load() || ctx.Err() != nil {
+			break
+		}
+		rs := s
+		if jobs > 1 {
+			owner, repo := common.ParseRepo(url)
+			rs = s.forRepo(owner + "/" + repo)
+		}
+		started++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := task(ctx, rs, i); err != nil {
+				errs[i] = err
+				rs.Log.Error("%v", err)
+				if strict {
+					stop.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		s.Log.Warn("批量下载已中断，已处理 %d / %d 个仓库，失败 %d 个", started, len(urls), len(failed))
+		return err
+	}
+	if len(urls) > 1 {
+		s.report(urls[:started], errs)
+	}
+	if len(failed) > 0 {
+		return &common.BatchError{Unit: "repositories", Failed: len(failed), Total: started, Errs: failed}
+	}
+	return nil
+}
+
+// report logs the outcome of every repository of a batch
+func (s *Session) report(urls []string, errs []error) {
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	s.Log.Info("汇总: 共 %d 个仓库，成功 %d，失败 %d", len(urls), len(urls)-failed, failed)
+	for i, url := range urls {
+		owner, repo := common.ParseRepo(url)
+		if errs[i] != nil {
+			s.Log.Error("  %s/%s: %v", owner, repo, errs[i])
+		} else {
+			s.Log.Info("  %s/%s: 完成", owner, repo)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+type (
+	// Progress receives the progress of the files of one repository
+	Progress interface {
+		// File starts tracking the download of a file
+		File(name string) FileProgress
+		// Wait blocks until every tracked file is done
+		Wait()
+	}
+	// FileProgress tracks the download of one file
+	FileProgress interface {
+		SetTotal(total int64)
+		SetCurrent(current int64)
+		// ProxyReader counts the bytes read through r
+		ProxyReader(r io.Reader) io.Reader
+		// Retry reports that attempt failed and the download restarts
+		Retry(attempt int)
+		// Skip completes a file that did not need downloading
+		Skip(size int64)
+		// Done completes the file, err is nil on success
+		Done(err error)
+	}
+)
+
+// groupSpan separates the bar priorities of concurrent repositories
+const groupSpan = 1 << 20
+
+type (
+	// barPool shares one mpb display between the repositories downloading
+	// at the same time
+	barPool struct {
+		mu     sync.Mutex
+		p      *mpb.Progress
+		groups int
+		base   int
+	}
+	// barGroup is the header line and file bars of one repository
+	barGroup struct {
+		pool    *barPool
+		header  *mpb.Bar
+		base    int
+		seq     atomic.Int32
+		started atomic.Int32
+		done    atomic.Int32
+		mu      sync.Mutex
+		bars    []*mpb.Bar
+	}
+)
+
+// NewBarProgress returns a progress factory drawing terminal bars. Each
+// repository gets a header line with its name above the bars of its
+// files, repositories downloading at the same time share the display.
+func NewBarProgress() func(repo string) Progress {
+	pool := new(barPool)
+	return pool.group
+}
+
+func (bp *barPool) group(repo string) Progress {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.p == nil {
+		bp.p = mpb.New(mpb.WithWidth(60))
+		bp.base = 0
+	}
+	bp.groups++
+	g := &barGroup{pool: bp, base: bp.base}
+	bp.base += groupSpan
+	g.header = bp.p.New(0, mpb.NopStyle(),
+		mpb.BarPriority(g.base),
+		mpb.PrependDecorators(decor.Name(repo+" ")),
+		mpb.AppendDecorators(decor.Any(func(decor.Statistics) string {
+			return fmt.Sprintf("%d / %d", g.done.Load(), g.started.Load())
+		})),
+	)
+	return g
+}
+
+// release waits for the display once its last repository is done
+func (bp *barPool) release() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.groups--
+	if bp.groups == 0 {
+		bp.p.Wait()
+		bp.p = nil
+	}
+}
+
+func (g *barGroup) File(name string) FileProgress {
+	g.started.Add(1)
+	fb := newFileBar(g.pool.p, name, mpb.BarPriority(g.base+1+int(g.seq.Add(1))))
+	fb.finished = func() { g.done.Add(1) }
+	g.mu.Lock()
+	g.bars = append(g.bars, fb.bar)
+	g.mu.Unlock()
+	return fb
+}
+
+func (g *barGroup) Wait() {
+	g.mu.Lock()
+	bars := g.bars
+	g.mu.Unlock()
+	for _, bar := range bars {
+		bar.Wait()
+	}
+	g.header.SetTotal(-1, true)
+	g.pool.release()
+}
+
+// fileBar is a download progress bar that also shows the retry attempt
+// and whether the file was skipped
+type fileBar struct {
+	bar      *mpb.Bar
+	attempt  atomic.Int32
+	skipped  atomic.Bool
+	finished func()
+}
+
+func newFileBar(p *mpb.Progress, fileName string, opts ...mpb.BarOption) *fileBar {
+	fb := new(fileBar)
+	fb.bar = p.New(0,
+		mpb.BarStyle().Rbound("⠿").Filler("⠶").Tip("⠿").Padding(" "),
+		append(opts, mpb.PrependDecorators(
+			decor.Name(fileName+" ", decor.WC{W: 30, C: decor.DSyncWidth}),
+			decor.Any(func(decor.Statistics) string {
+				if fb.skipped.Load() {
+					return "已存在 "
+				}
+				if n := fb.attempt.Load(); n > 0 {
+					return fmt.Sprintf("重试 %d ", n)
+				}
+				return ""
+			}, decor.WC{W: 8}),
+		),
+			mpb.AppendDecorators(
+				decor.Percentage(decor.WC{W: 5}),
+				decor.CountersKibiByte("% .1f / % .1f"),
+			))...,
+	)
+	return fb
+}
+
+func (fb *fileBar) SetTotal(total int64) {
+	fb.bar.SetTotal(total, false)
+}
+
+func (fb *fileBar) SetCurrent(current int64) {
+	fb.bar.SetCurrent(current)
+}
+
+func (fb *fileBar) ProxyReader(r io.Reader) io.Reader {
+	return fb.bar.ProxyReader(r)
+}
+
+func (fb *fileBar) Retry(attempt int) {
+	fb.attempt.Store(int32(attempt))
+	fb.bar.SetCurrent(0)
+}
+
+func (fb *fileBar) Skip(size int64) {
+	fb.skipped.Store(true)
+	fb.bar.SetTotal(size, false)
+	fb.bar.SetCurrent(size)
+	fb.bar.SetTotal(size, true)
+	fb.finished()
+}
+
+func (fb *fileBar) Done(err error) {
+	defer fb.finished()
+	if err != nil {
+		fb.bar.Abort(false)
+		return
+	}
+	fb.bar.SetTotal(fb.bar.Current(), true)
+}
+
+// nopProgress discards progress
+type nopProgress struct{}
+
+func (nopProgress) File(string) FileProgress          { return nopProgress{} }
+func (nopProgress) Wait()                             {}
+func (nopProgress) SetTotal(int64)                    {}
+func (nopProgress) SetCurrent(int64)                  {}
+func (nopProgress) ProxyReader(r io.Reader) io.Reader { return r }
+func (nopProgress) Retry(int)                         {}
+func (nopProgress) Skip(int64)                        {}
+func (nopProgress) Done(error)                        {}
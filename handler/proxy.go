@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Fromsko/downhub/common"
+	"github.com/Fromsko/downhub/config"
+)
+
+// ProxyExplanation tells how the requests to a URL are routed
+type ProxyExplanation struct {
+	URL  string
+	Host string
+	// Rule is the index of the network.proxy_rules entry that matched, -1
+	// when none did and the default proxy applied
+	Rule  int
+	Match string
+	// Default is where the default proxy comes from: --proxy, the
+	// environment, defaults.proxy, or "" when there is none; ", PAC" is
+	// appended when it is a PAC script
+	Default string
+	// Proxy is the redacted proxy URL, "" for a direct connection
+	Proxy string
+	// Addrs are the addresses a direct connection dials, set when
+	// network.hosts or network.dns is configured
+	Addrs []string
+}
+
+// ExplainProxy returns the route of rawURL with explicit as the --proxy
+func ExplainProxy(ctx context.Context, rawURL, explicit string) (ProxyExplanation, error) {
+	return defaultSession().ExplainProxy(ctx, rawURL, explicit)
+}
+
+// ExplainProxy returns the route the session transports take to rawURL,
+// a bare host name meaning https
+func (s *Session) ExplainProxy(ctx context.Context, rawURL, explicit string) (ProxyExplanation, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ProxyExplanation{}, fmt.Errorf("invalid URL %q", rawURL)
+	}
+	proxy := s.proxy(explicit)
+	var n config.Network
+	if s.Config != nil {
+		n = s.Config.Network
+	}
+	var resolver common.Resolver
+	if len(n.Hosts) > 0 || n.DNS != "" {
+		r, err := common.NewHostResolver(n)
+		if err != nil {
+			return ProxyExplanation{}, err
+		}
+		resolver = r
+	}
+	router, err := common.NewProxyRouter(n.ProxyRules, proxy, resolver)
+	if err != nil {
+		return ProxyExplanation{}, err
+	}
+	route, err := router.Route(ctx, u)
+	if err != nil {
+		return ProxyExplanation{}, err
+	}
+
+	e := ProxyExplanation{URL: rawURL, Host: u.Hostname(), Rule: route.Rule, Match: route.Match}
+	if route.Proxy != nil {
+		e.Proxy = route.Proxy.Redacted()
+	} else if resolver != nil {
+		addrs, err := resolver.LookupIPAddr(ctx, e.Host)
+		if err != nil {
+			return e, err
+		}
+		for _, addr := range addrs {
+			e.Addrs = append(e.Addrs, addr.String())
+		}
+	}
+	switch {
+	case explicit != "":
+		e.Default = "--proxy"
+	case common.EnvProxy():
+		e.Default = "HTTP_PROXY/HTTPS_PROXY"
+	case proxy != "":
+		e.Default = "defaults.proxy"
+	}
+	if common.IsPAC(proxy) {
+		e.Default += ", PAC"
+	}
+	return e, nil
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Fromsko/downhub/catalog"
+	"github.com/Fromsko/downhub/common"
+)
+
+// urlTag extracts the tag of a source archive or release asset URL
+func urlTag(fileURL string) string {
+	if _, rest, ok := strings.Cut(fileURL, "/archive/refs/tags/"); ok {
+		return strings.TrimSuffix(strings.TrimSuffix(rest, ".zip"), ".tar.gz")
+	}
+	if _, rest, ok := strings.Cut(fileURL, "/releases/download/"); ok {
+		if i := strings.LastIndex(rest, "/"); i >= 0 {
+			return rest[:i]
+		}
+	}
+	return ""
+}
+
+// tagCommit returns the commit of a discovered tag
+func tagCommit(hub *common.DownHub, tag string) string {
+	for _, t := range hub.Tags {
+		if t.Name == tag {
+			return t.Commit
+		}
+	}
+	return ""
+}
+
+// docURL returns the blob URL of a file of a repository at commit
+func docURL(repoURL, commit, filePath string) string {
+	return strings.TrimSuffix(repoURL, "/") + "/blob/" + commit + "/" + filePath
+}
+
+// recordDownload writes the outcome of a download to the catalog
+func (s *Session) recordDownload(hub *common.DownHub, fileURL, path string, result downloadResult, started time.Time, err error) {
+	if result.Skipped {
+		// Keep the original record of a file that was already there
+		if record, ok := s.lookup(path); ok && record.Status == catalog.StatusDownloaded {
+			return
+		}
+	}
+	owner, repo := common.ParseRepo(hub.BaseUrl)
+	tag := urlTag(fileURL)
+	record := catalog.Record{
+		Repo:         owner + "/" + repo,
+		Tag:          tag,
+		Commit:       tagCommit(hub, tag),
+		URL:          fileURL,
+		Path:         path,
+		SHA256:       result.Digest,
+		ETag:         result.ETag,
+		LastModified: result.LastModified,
+		Status:       catalog.StatusDownloaded,
+		StartedAt:    started,
+		FinishedAt:   time.Now(),
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		record.Size = info.Size()
+	}
+	if err != nil {
+		record.Status = catalog.StatusFailed
+		record.Error = err.Error()
+	}
+	s.record(record)
+}
+
+// recordQuarantined marks files that failed checksum verification
+func (s *Session) recordQuarantined(paths []string) {
+	for _, path := range paths {
+		record, ok := s.lookup(path)
+		if !ok {
+			continue
+		}
+		record.Status = catalog.StatusQuarantined
+		record.Error = "checksum mismatch, moved to " + filepath.Join(filepath.Dir(path), quarantineDir)
+		s.record(record)
+	}
+}
+
+// recordDocFile writes the outcome of a docs file export to the catalog
+func (s *Session) recordDocFile(repoURL, commit, filePath, path string, started time.Time, err error) {
+	owner, repo := common.ParseRepo(repoURL)
+	record := catalog.Record{
+		Repo:       owner + "/" + repo,
+		Commit:     commit,
+		URL:        docURL(repoURL, commit, filePath),
+		Path:       path,
+		Status:     catalog.StatusDownloaded,
+		StartedAt:  started,
+		FinishedAt: time.Now(),
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		record.Size = info.Size()
+	}
+	if err != nil {
+		record.Status = catalog.StatusFailed
+		record.Error = err.Error()
+	}
+	s.record(record)
+}
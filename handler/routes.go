@@ -0,0 +1,356 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/common"
+)
+
+const (
+	// routeCacheFile keeps the rankings under base_data_dir across runs
+	routeCacheFile = "routes.json"
+	// defaultProbeInterval is how long a ranking is used when
+	// network.probe.interval is unset
+	defaultProbeInterval = 5 * time.Minute
+	// probeTimeout bounds the probes of one host
+	probeTimeout = 10 * time.Second
+)
+
+type (
+	// fetchRoute is one way to fetch a URL: from source through proxy
+	fetchRoute struct {
+		source common.MirrorURL
+		proxy  string
+	}
+	// rankedRoute is the probe result of a route, as kept in the cache
+	// file: the proxy is redacted
+	rankedRoute struct {
+		Mirror     string  `json:"mirror,omitempty"`
+		Proxy      string  `json:"proxy"`
+		Latency    int64   `json:"latency_ms"`
+		Throughput float64 `json:"throughput"`
+		Error      string  `json:"error,omitempty"`
+	}
+	// hostRanking ranks the routes to a host, fastest first
+	hostRanking struct {
+		Probed time.Time     `json:"probed"`
+		Routes []rankedRoute `json:"routes"`
+	}
+	// routeTable holds the rankings of a session, see Session.routes
+	routeTable struct {
+		mu      sync.Mutex
+		path    string
+		hosts   map[string]*hostRanking
+		probing map[string]chan struct{}
+	}
+)
+
+// String describes the route for logs
+func (r fetchRoute) String() string {
+	return r.source.Source() + " (" + proxyName(r.proxy) + ")"
+}
+
+// proxyName names a proxy for display, its password redacted
+func proxyName(proxy string) string {
+	switch {
+	case proxy == "" && common.EnvProxy():
+		return "环境变量代理"
+	case proxy == "", proxy == common.ProxyDirect:
+		return "直连"
+	}
+	return common.RedactProxy(proxy)
+}
+
+// routes returns the route table of the session, nil when
+// network.probe.enabled is off or an injected client serves every request
+func (s *Session) routes() *routeTable {
+	if s.parent != nil {
+		return s.parent.routes()
+	}
+	s.routeOnce.Do(func() {
+		if s.Config == nil || !s.Config.Network.Probe.Enabled || s.HTTP != nil {
+			return
+		}
+		baseDataDir := "data"
+		if s.Config.Defaults.BaseDataDir != "" {
+			baseDataDir = s.Config.Defaults.BaseDataDir
+		}
+		t := &routeTable{
+			path:    filepath.Join(baseDataDir, routeCacheFile),
+			hosts:   make(map[string]*hostRanking),
+			probing: make(map[string]chan struct{}),
+		}
+		if data, err := os.ReadFile(t.path); err == nil {
+			json.Unmarshal(data, &t.hosts)
+		}
+		s.routeTab = t
+	})
+	return s.routeTab
+}
+
+// probeInterval returns network.probe.interval
+func (s *Session) probeInterval() time.Duration {
+	if s.Config != nil && s.Config.Network.Probe.Interval > 0 {
+		return time.Duration(s.Config.Network.Probe.Interval) * time.Second
+	}
+	return defaultProbeInterval
+}
+
+// probeProxies returns the proxies raced: proxy itself and
+// network.probe.proxies. Direct connections are only raced when proxy is
+// unset or the list names "direct", so a required proxy is never bypassed.
+func (s *Session) probeProxies(proxy string) []string {
+	if proxy == "" && !common.EnvProxy() {
+		proxy = common.ProxyDirect
+	}
+	proxies := []string{proxy}
+	for _, p := range s.Config.Network.Probe.Proxies {
+		if p != "" && !slices.Contains(proxies, p) {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// fetchRoutes returns the routes rawURL, a URL of kind, is fetched through
+// in order. Without probing these are each mirror and then the origin
+// through proxy; with probing the working routes of the host ranking come
+// first, fastest first.
+func (s *Session) fetchRoutes(ctx context.Context, kind, rawURL, proxy string) []fetchRoute {
+	sources := common.MirrorURLs(s.Config, kind, rawURL)
+	t := s.routes()
+	var proxies []string
+	if t != nil {
+		proxies = s.probeProxies(proxy)
+		proxy = proxies[0]
+	}
+	routes := make([]fetchRoute, 0, len(sources))
+	for _, source := range sources {
+		routes = append(routes, fetchRoute{source: source, proxy: proxy})
+	}
+	if t == nil || len(sources)*len(proxies) < 2 {
+		return routes
+	}
+
+	var ranked []fetchRoute
+	for _, r := range s.ranking(ctx, t, rawURL, proxies) {
+		if r.Error != "" {
+			continue
+		}
+		for _, source := range sources {
+			for _, p := range proxies {
+				if source.Mirror == r.Mirror && common.RedactProxy(p) == r.Proxy {
+					ranked = append(ranked, fetchRoute{source: source, proxy: p})
+				}
+			}
+		}
+	}
+	for _, route := range routes {
+		if !slices.Contains(ranked, route) {
+			ranked = append(ranked, route)
+		}
+	}
+	return ranked
+}
+
+// probeCandidates returns every route to the host of rawURL: each mirror,
+// whatever kinds it serves, and the origin through each proxy
+func (s *Session) probeCandidates(rawURL string, proxies []string) []fetchRoute {
+	var candidates []fetchRoute
+	for _, source := range common.MirrorURLs(s.Config, "", rawURL) {
+		for _, p := range proxies {
+			candidates = append(candidates, fetchRoute{source: source, proxy: p})
+		}
+	}
+	return candidates
+}
+
+// ranking returns the ranking of the host of rawURL. The host is probed
+// when it has none yet, or none for the current mirrors and proxies; a
+// ranking older than network.probe.interval is still used while the host
+// is probed again in the background.
+func (s *Session) ranking(ctx context.Context, t *routeTable, rawURL string, proxies []string) []rankedRoute {
+	host := urlHost(rawURL)
+	candidates := s.probeCandidates(rawURL, proxies)
+
+	t.mu.Lock()
+	r := t.hosts[host]
+	if r != nil && r.covers(candidates) {
+		if time.Since(r.Probed) >= s.probeInterval() && t.probing[host] == nil {
+			done := make(chan struct{})
+			t.probing[host] = done
+			go s.probe(ctx, t, host, candidates, done)
+		}
+		t.mu.Unlock()
+		return r.Routes
+	}
+	done, running := t.probing[host]
+	if !running {
+		done = make(chan struct{})
+		t.probing[host] = done
+	}
+	t.mu.Unlock()
+
+	if running {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil
+		}
+	} else {
+		s.probe(ctx, t, host, candidates, done)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r := t.hosts[host]; r != nil {
+		return r.Routes
+	}
+	return nil
+}
+
+// covers reports whether r ranks exactly the candidates
+func (r *hostRanking) covers(candidates []fetchRoute) bool {
+	if len(r.Routes) != len(candidates) {
+		return false
+	}
+	for _, c := range candidates {
+		if !slices.ContainsFunc(r.Routes, func(rr rankedRoute) bool {
+			return rr.Mirror == c.source.Mirror && rr.Proxy == common.RedactProxy(c.proxy)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// probe measures every candidate route to host at once, then stores and
+// saves the ranking and closes done
+func (s *Session) probe(ctx context.Context, t *routeTable, host string, candidates []fetchRoute, done chan struct{}) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.probing, host)
+		t.mu.Unlock()
+		close(done)
+	}()
+
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	results := make([]common.ProbeResult, len(candidates))
+	var wg sync.WaitGroup
+	for i, c := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := s.httpClient(c.proxy)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			results[i] = common.Probe(probeCtx, client, c.source.URL)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return results[order[a]].Faster(results[order[b]])
+	})
+	ranking := &hostRanking{Probed: time.Now()}
+	for _, i := range order {
+		c, res := candidates[i], results[i]
+		r := rankedRoute{
+			Mirror:     c.source.Mirror,
+			Proxy:      common.RedactProxy(c.proxy),
+			Latency:    res.Latency.Milliseconds(),
+			Throughput: res.Throughput,
+		}
+		if res.Err != nil {
+			r.Error = res.Err.Error()
+			s.Log.Debug("线路测速 %s: %s 失败: %v", host, c, res.Err)
+		} else {
+			s.Log.Debug("线路测速 %s: %s %dms %s", host, c, r.Latency, common.FormatBandwidth(int64(r.Throughput)))
+		}
+		ranking.Routes = append(ranking.Routes, r)
+	}
+	if best := candidates[order[0]]; results[order[0]].Err == nil {
+		s.Log.Info("线路测速 %s: 最快为 %s", host, best)
+	} else {
+		s.Log.Warn("线路测速 %s: 所有线路均不可用", host)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hosts[host] = ranking
+	if err := t.save(); err != nil {
+		s.Log.Warn("保存测速结果失败: %v", err)
+	}
+}
+
+// save writes the rankings to the cache file, t.mu held
+func (t *routeTable) save() error {
+	data, err := json.MarshalIndent(t.hosts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, data, 0644)
+}
+
+// RouteProbe is the measurement of one route to a host
+type RouteProbe struct {
+	Route      string
+	Latency    time.Duration
+	Throughput float64
+	Error      string
+}
+
+// ProbeRoutes ranks the routes to the host of rawURL with the package
+// configuration
+func ProbeRoutes(ctx context.Context, rawURL, explicit string) []RouteProbe {
+	return defaultSession().ProbeRoutes(ctx, rawURL, explicit)
+}
+
+// ProbeRoutes ranks the routes to the host of rawURL, through every mirror
+// and the origin and every proxy, fastest first, probing unless a fresh
+// ranking is cached. It returns nil when probing is off or there is a
+// single route.
+func (s *Session) ProbeRoutes(ctx context.Context, rawURL, explicit string) []RouteProbe {
+	t := s.routes()
+	if t == nil {
+		return nil
+	}
+	proxies := s.probeProxies(s.proxy(explicit))
+	candidates := s.probeCandidates(rawURL, proxies)
+	if len(candidates) < 2 {
+		return nil
+	}
+	var probes []RouteProbe
+	for _, r := range s.ranking(ctx, t, rawURL, proxies) {
+		for _, c := range candidates {
+			if c.source.Mirror == r.Mirror && common.RedactProxy(c.proxy) == r.Proxy {
+				probes = append(probes, RouteProbe{
+					Route:      c.String(),
+					Latency:    time.Duration(r.Latency) * time.Millisecond,
+					Throughput: r.Throughput,
+					Error:      r.Error,
+				})
+			}
+		}
+	}
+	return probes
+}
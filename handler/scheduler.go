@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+)
+
+type (
+	// scheduler runs the downloads of every repository of a session on one
+	// pool of workers. Repositories take turns so a large one cannot starve
+	// the others; hosts are capped per request, see hostSlots.
+	scheduler struct {
+		mu      sync.Mutex
+		cond    *sync.Cond
+		workers int
+		running int
+		// groups with queued tasks, served round-robin from next
+		groups []*jobGroup
+		next   int
+	}
+	// jobGroup is the queue of one repository
+	jobGroup struct {
+		sched  *scheduler
+		limit  int
+		active int
+		queue  []func()
+		wg     sync.WaitGroup
+	}
+	// hostSlots caps the requests in flight to each host, counting the host
+	// each request actually dials: mirrors and redirect targets included
+	hostSlots struct {
+		mu    sync.Mutex
+		wake  chan struct{}
+		used  map[string]int
+		limit func(host string) int
+	}
+)
+
+func newScheduler(workers int) *scheduler {
+	s := &scheduler{workers: workers}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// group returns a new queue running at most limit tasks at once, 0 for no
+// limit beyond the pool size
+func (s *scheduler) group(limit int) *jobGroup {
+	return &jobGroup{sched: s, limit: limit}
+}
+
+// submit queues run
+func (g *jobGroup) submit(run func()) {
+	s := g.sched
+	g.wg.Add(1)
+	s.mu.Lock()
+	if len(g.queue) == 0 {
+		s.groups = append(s.groups, g)
+	}
+	g.queue = append(g.queue, run)
+	if s.running < s.workers {
+		s.running++
+		go s.work()
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// wait blocks until every task of the group has run
+func (g *jobGroup) wait() {
+	g.wg.Wait()
+}
+
+// work runs tasks until nothing is queued
+func (s *scheduler) work() {
+	s.mu.Lock()
+	for len(s.groups) > 0 {
+		g, run, ok := s.take()
+		if !ok {
+			// Everything queued waits for a group slot
+			s.cond.Wait()
+			continue
+		}
+		g.active++
+		s.mu.Unlock()
+
+		run()
+
+		s.mu.Lock()
+		g.active--
+		g.wg.Done()
+		s.cond.Broadcast()
+	}
+	s.running--
+	s.mu.Unlock()
+}
+
+// take removes the next runnable task, visiting the groups in turn
+func (s *scheduler) take() (*jobGroup, func(), bool) {
+	for n := 0; n < len(s.groups); n++ {
+		i := (s.next + n) % len(s.groups)
+		g := s.groups[i]
+		if g.limit > 0 && g.active >= g.limit {
+			continue
+		}
+		run := g.queue[0]
+		g.queue = g.queue[1:]
+		s.next = i + 1
+		if len(g.queue) == 0 {
+			s.groups = append(s.groups[:i], s.groups[i+1:]...)
+			s.next = i
+		}
+		if len(s.groups) > 0 {
+			s.next %= len(s.groups)
+		}
+		return g, run, true
+	}
+	return nil, nil, false
+}
+
+// scheduler returns the scheduler of the session, sized by poolSize
+func (s *Session) scheduler() *scheduler {
+	if s.parent != nil {
+		return s.parent.scheduler()
+	}
+	s.schedOnce.Do(func() {
+		s.sched = newScheduler(s.poolSize())
+	})
+	return s.sched
+}
+
+// hostSlots returns the per-host request caps of the session
+func (s *Session) hostSlots() *hostSlots {
+	if s.parent != nil {
+		return s.parent.hostSlots()
+	}
+	s.slotOnce.Do(func() {
+		s.slots = &hostSlots{wake: make(chan struct{}), used: make(map[string]int), limit: s.hostLimit}
+	})
+	return s.slots
+}
+
+// acquire blocks until host has a free slot or ctx is done
+func (h *hostSlots) acquire(ctx context.Context, host string) error {
+	h.mu.Lock()
+	for {
+		if limit := h.limit(host); limit <= 0 || h.used[host] < limit {
+			h.used[host]++
+			h.mu.Unlock()
+			return nil
+		}
+		wake := h.wake
+		h.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+		h.mu.Lock()
+	}
+}
+
+// release frees a slot of host
+func (h *hostSlots) release(host string) {
+	h.mu.Lock()
+	h.used[host]--
+	close(h.wake)
+	h.wake = make(chan struct{})
+	h.mu.Unlock()
+}
+
+// free returns how many more requests host allows now, -1 when uncapped
+func (h *hostSlots) free(host string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	limit := h.limit(host)
+	if limit <= 0 {
+		return -1
+	}
+	return max(limit-h.used[host], 0)
+}
+
+// Transport holds a slot of the request host from each request until its
+// response body is closed. http.Client sends every redirect as a request
+// of its own, so the slot is that of the host finally answering.
+func (h *hostSlots) Transport(rt http.RoundTripper) http.RoundTripper {
+	return slotTransport{next: rt, slots: h}
+}
+
+type slotTransport struct {
+	next  http.RoundTripper
+	slots *hostSlots
+}
+
+func (t slotTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if err := t.slots.acquire(req.Context(), host); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.slots.release(host)
+		return nil, err
+	}
+	resp.Body = &slotBody{ReadCloser: resp.Body, release: func() { t.slots.release(host) }}
+	return resp, nil
+}
+
+// slotBody releases the host slot of a response on its first Close
+type slotBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *slotBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// poolSize returns max_concurrent_downloads, 5 when unset
+func (s *Session) poolSize() int {
+	if s.Config != nil && s.Config.Defaults.MaxConcurrentDownloads > 0 {
+		return s.Config.Defaults.MaxConcurrentDownloads
+	}
+	return 5
+}
+
+// hostLimit returns the connection cap of host from download.host_limits
+// (exact host or glob), falling back to download.max_per_host; 0 means
+// only the pool size applies
+func (s *Session) hostLimit(host string) int {
+	if s.Config == nil {
+		return 0
+	}
+	limits := s.Config.Download.HostLimits
+	if limit, ok := limits[host]; ok {
+		return limit
+	}
+	patterns := make([]string, 0, len(limits))
+	for pattern := range limits {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return limits[pattern]
+		}
+	}
+	return s.Config.Download.MaxPerHost
+}
+
+// urlHost returns the host a URL is fetched from
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Fromsko/downhub/common"
+)
+
+// defaultSegmentMinSize is the smallest file split into segments when
+// download.segment_min_size is unset
+const defaultSegmentMinSize = 64 << 20
+
+// errRangeIgnored is returned for a segment whose range request was
+// answered with the whole file, i.e. the file changed upstream
+var errRangeIgnored = errors.New("range request ignored")
+
+// segment is the byte range [Start, End) of a file, Done bytes of which
+// are on disk
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func (seg *segment) remaining() int64 {
+	return seg.End - seg.Start - seg.Done
+}
+
+// splitSegments splits size bytes into n contiguous segments
+func splitSegments(size int64, n int) []segment {
+	segments := make([]segment, n)
+	step := size / int64(n)
+	for i := range segments {
+		segments[i].Start = int64(i) * step
+		segments[i].End = segments[i].Start + step
+	}
+	segments[n-1].End = size
+	return segments
+}
+
+// segmentCount returns how many ranges the file of a fresh response is
+// fetched in: download.segments, capped by the connections its host and
+// the download pool have left besides the one of resp, or 1 when ranges
+// are not supported, the size is unknown or below
+// download.segment_min_size, or there is no validator for If-Range
+func (s *Session) segmentCount(resp *http.Response, meta *partMeta) int {
+	if s.Config == nil || s.Config.Download.Segments < 2 {
+		return 1
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || meta.validator() == "" {
+		return 1
+	}
+	minSize := int64(defaultSegmentMinSize)
+	if size, err := common.ParseSize(s.Config.Download.SegmentMinSize); err == nil && size > 0 {
+		minSize = size
+	}
+	if resp.ContentLength < minSize {
+		return 1
+	}
+	n := s.Config.Download.Segments
+	if free := s.hostSlots().free(resp.Request.URL.Hostname()); free >= 0 {
+		n = min(n, 1+free)
+	}
+	if free := s.poolLimit().Free(); free >= 0 {
+		n = min(n, 1+free)
+	}
+	return int(min(int64(n), resp.ContentLength))
+}
+
+// fetchSegments downloads the unfinished segments of meta concurrently
+// into path.part and renames it into place once every one is complete.
+// When body is set the download starts afresh: the file is allocated and
+// the first segment is read from body. Progress is saved to the sidecar
+// so that the next attempt or run resumes each segment.
+func (s *Session) fetchSegments(ctx context.Context, httpClient *http.Client, fetchUrl, path string, bar FileProgress, h hash.Hash, meta *partMeta, body io.Reader) error {
+	flags := os.O_CREATE | os.O_WRONLY
+	if body != nil {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(path+partSuffix, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		if err := out.Truncate(meta.Size); err != nil {
+			out.Close()
+			return err
+		}
+		s.Log.Info("分段下载: %s, %d 个连接", filepath.Base(path), len(meta.Segments))
+	} else {
+		s.Log.Info("断点续传: %s, 继续 %d 个分段", filepath.Base(path), len(meta.Segments))
+	}
+	if err := savePartMeta(path, meta); err != nil {
+		out.Close()
+		return err
+	}
+
+	var done int64
+	for _, seg := range meta.Segments {
+		done += seg.Done
+	}
+	bar.SetTotal(meta.Size)
+	bar.SetCurrent(done)
+
+	segCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(meta.Segments))
+	var wg sync.WaitGroup
+	// The first segment runs on the pool slot of the download, the others
+	// take one each; their host slots are taken by the requests
+	extra := false
+	for i := range meta.Segments {
+		seg := &meta.Segments[i]
+		if seg.remaining() == 0 {
+			continue
+		}
+		var r io.Reader
+		if i == 0 {
+			r = body
+		}
+		wg.Add(1)
+		go func(extra bool) {
+			defer wg.Done()
+			if extra {
+				limit := s.poolLimit()
+				if err := limit.Acquire(segCtx); err != nil {
+					errs[i] = err
+					return
+				}
+				defer limit.Release()
+			}
+			if err := s.fetchSegment(segCtx, httpClient, fetchUrl, meta, seg, out, bar, r); err != nil {
+				errs[i] = err
+				// Stop the other segments, the attempt is retried as a whole
+				cancel()
+			}
+		}(extra)
+		extra = true
+	}
+	wg.Wait()
+	closeErr := out.Close()
+
+	if err := ctx.Err(); err != nil {
+		savePartMeta(path, meta)
+		return err
+	}
+	for _, err := range errs {
+		switch {
+		case errors.Is(err, errRangeIgnored):
+			removePart(path)
+			return fmt.Errorf("resume %s: file changed upstream, restarting: %w", fetchUrl, common.ErrRetryable)
+		case err != nil && !errors.Is(err, context.Canceled):
+			savePartMeta(path, meta)
+			return err
+		}
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if h != nil {
+		h.Reset()
+		if err := hashFile(h, path+partSuffix); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(path+partSuffix, path); err != nil {
+		return err
+	}
+	os.Remove(path + metaSuffix)
+	return nil
+}
+
+// fetchSegment downloads the rest of seg into out, from body when set or
+// else with a Range request guarded by If-Range
+func (s *Session) fetchSegment(ctx context.Context, httpClient *http.Client, fetchUrl string, meta *partMeta, seg *segment, out *os.File, bar FileProgress, body io.Reader) error {
+	offset := seg.Start + seg.Done
+	if body == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fetchUrl, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, seg.End-1))
+		req.Header.Set("If-Range", meta.validator())
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("request failed: %w", err)
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if start, err := contentRangeStart(resp.Header.Get("Content-Range")); err != nil || start != offset {
+				return errRangeIgnored
+			}
+		case http.StatusOK, http.StatusRequestedRangeNotSatisfiable:
+			return errRangeIgnored
+		default:
+			return common.NewHTTPStatusError(resp)
+		}
+		body = resp.Body
+	}
+
+	r := io.LimitReader(body, seg.remaining())
+	n, err := io.Copy(io.NewOffsetWriter(out, offset), bar.ProxyReader(s.transferReader(ctx, r)))
+	seg.Done += n
+	if err == nil && seg.remaining() > 0 {
+		err = fmt.Errorf("short body for %s: %w", fetchUrl, io.ErrUnexpectedEOF)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/catalog"
+	"github.com/Fromsko/downhub/common"
+	"github.com/Fromsko/downhub/config"
+)
+
+// Session carries the configuration and collaborators of downloads instead
+// of the package globals, so differently configured sessions can share a
+// process
+type Session struct {
+	Config *config.Config
+	// HTTP serves every HTTP request when set, the proxy options are then
+	// left to its transport
+	HTTP *http.Client
+	// Transports builds the HTTP clients when HTTP is nil, its hooks wrap
+	// every request
+	Transports *common.Transports
+	Log        common.Logger
+	// NewProgress creates the progress sink of one repository download,
+	// progress is not reported when nil
+	NewProgress func(repo string) Progress
+	// Catalog records downloads, nil disables the journal and the
+	// skipping of files already downloaded
+	Catalog *catalog.Catalog
+	// GitTransport sends the git requests of ls-remote and clones through
+	// the session clients. go-git only has process-wide transports, so
+	// this installs common.InstallGitTransport for the whole process; when
+	// off, git uses whatever go-git clients are installed.
+	GitTransport bool
+
+	// parent is the session a per-repository view was made from
+	parent    *Session
+	schedOnce sync.Once
+	sched     *scheduler
+	slotOnce  sync.Once
+	slots     *hostSlots
+	limOnce   sync.Once
+	lim       *common.Limiter
+	adaptOnce sync.Once
+	spiderLim *common.AdaptiveLimit
+	poolLim   *common.AdaptiveLimit
+	routeOnce sync.Once
+	routeTab  *routeTable
+}
+
+// prefixLogger prefixes every message, e.g. with owner/repo
+type prefixLogger struct {
+	common.Logger
+	prefix string
+}
+
+func (l prefixLogger) Debug(msg string, args ...any) { l.Logger.Debug(l.prefix+msg, args...) }
+func (l prefixLogger) Info(msg string, args ...any)  { l.Logger.Info(l.prefix+msg, args...) }
+func (l prefixLogger) Warn(msg string, args ...any)  { l.Logger.Warn(l.prefix+msg, args...) }
+func (l prefixLogger) Error(msg string, args ...any) { l.Logger.Error(l.prefix+msg, args...) }
+
+// NewSession returns a session using c that logs through common.Log and
+// neither reports progress nor keeps a catalog
+func NewSession(c *config.Config) *Session {
+	s := &Session{Config: c, Log: common.Log, Transports: common.NewTransports(c)}
+	s.Transports.Log = s.Log
+	return s
+}
+
+var (
+	defaultOnce sync.Once
+	defaultSess *Session
+)
+
+// defaultSession is the session of the package configuration used by the
+// command line: progress bars and the catalog under base_data_dir. It is
+// created on first use, after SetConfig.
+func defaultSession() *Session {
+	defaultOnce.Do(func() {
+		s := NewSession(cfg)
+		s.GitTransport = true
+		s.NewProgress = NewBarProgress()
+		c, err := catalog.Default()
+		if err != nil {
+			s.Log.Error("Open catalog: %v", err)
+		}
+		s.Catalog = c
+		defaultSess = s
+	})
+	return defaultSess
+}
+
+// forRepo returns a view of the session that prefixes log lines with repo
+// and shares its scheduler
+func (s *Session) forRepo(repo string) *Session {
+	return &Session{
+		Config:       s.Config,
+		HTTP:         s.HTTP,
+		Transports:   s.Transports,
+		Log:          prefixLogger{Logger: s.Log, prefix: "[" + repo + "] "},
+		NewProgress:  s.NewProgress,
+		Catalog:      s.Catalog,
+		GitTransport: s.GitTransport,
+		parent:       s,
+	}
+}
+
+// retryPolicy returns the retry policy of the session configuration
+func (s *Session) retryPolicy() common.RetryPolicy {
+	return common.RetryPolicyFor(s.Config)
+}
+
+// retryLogger logs every failed attempt before Retry sleeps
+func (s *Session) retryLogger(name string) common.RetryNotify {
+	return func(attempt int, err error, wait time.Duration) {
+		s.Log.Warn("重试: %s, 第 %d 次失败: %v, %s 后重试", name, attempt, err, wait.Round(time.Second))
+	}
+}
+
+// progress returns the progress sink of one repository download
+func (s *Session) progress(repo string) Progress {
+	if s.NewProgress == nil {
+		return nopProgress{}
+	}
+	return s.NewProgress(repo)
+}
+
+// record writes r to the session catalog, if any
+func (s *Session) record(r catalog.Record) {
+	if s.Catalog == nil {
+		return
+	}
+	if err := s.Catalog.Put(r); err != nil {
+		s.Log.Error("Update catalog: %v", err)
+	}
+}
+
+// lookup returns the catalog record of a local path
+func (s *Session) lookup(path string) (catalog.Record, bool) {
+	if s.Catalog == nil {
+		return catalog.Record{}, false
+	}
+	return s.Catalog.Get(path)
+}
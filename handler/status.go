@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Fromsko/downhub/catalog"
+	"github.com/Fromsko/downhub/common"
+)
+
+// RepoStatus compares the upstream artifacts of a repository with what is
+// already under its source directory
+type RepoStatus struct {
+	Repo     string   `json:"repo"`
+	Dir      string   `json:"dir"`
+	Upstream int      `json:"upstream"`
+	Local    int      `json:"local"`
+	New      []string `json:"new"`
+	Missing  []string `json:"missing"`
+	Extra    []string `json:"extra"`
+	Error    string   `json:"error,omitempty"`
+	// Err is the error behind Error
+	Err error `json:"-"`
+}
+
+// Status discovers the artifacts of url without downloading anything.
+// New artifacts were never downloaded, missing ones were downloaded
+// according to the catalog but are gone from disk, extra files exist
+// locally but no longer upstream.
+func Status(ctx context.Context, url string, opts DownloadOptions) RepoStatus {
+	return defaultSession().Status(ctx, url, opts)
+}
+
+// Status compares the upstream artifacts of url with the local ones
+func (s *Session) Status(ctx context.Context, url string, opts DownloadOptions) RepoStatus {
+	hub := s.newHub(url, opts)
+	owner, repo := common.ParseRepo(url)
+	status := RepoStatus{
+		Repo:    owner + "/" + repo,
+		Dir:     hub.DownDir,
+		New:     []string{},
+		Missing: []string{},
+		Extra:   []string{},
+	}
+
+	hub.Spider.Context = ctx
+	err := s.discoverTags(ctx, hub, regexp.MustCompile(hub.Link()))
+	if err == nil {
+		err = s.selectTags(hub)
+	}
+	if err != nil {
+		// Upstream is unknown: every local file would look extra
+		status.Err = err
+		status.Error = err.Error()
+		status.Local = len(localArtifacts(hub.DownDir))
+		return status
+	}
+	collectArchives(hub)
+	s.collectAssets(hub)
+	if len(hub.Tags) == 0 {
+		status.Error = "no tags found upstream"
+	}
+
+	expected := make(map[string]bool)
+	for _, fileURL := range append(hub.Zip, hub.TarGz...) {
+		expected[filepath.Join(hub.DownDir, filepath.Base(fileURL))] = true
+	}
+	for _, asset := range hub.Assets {
+		expected[filepath.Join(hub.DownDir, asset.Tag, filepath.Base(asset.URL))] = true
+	}
+	status.Upstream = len(expected)
+
+	local := localArtifacts(hub.DownDir)
+	status.Local = len(local)
+	for path := range expected {
+		if local[path] {
+			continue
+		}
+		rel, _ := filepath.Rel(hub.DownDir, path)
+		if record, ok := s.lookup(path); ok && record.Status == catalog.StatusDownloaded {
+			// Downloaded once and gone since; a failed attempt is still new
+			status.Missing = append(status.Missing, rel)
+		} else {
+			status.New = append(status.New, rel)
+		}
+	}
+	for path := range local {
+		if !expected[path] {
+			rel, _ := filepath.Rel(hub.DownDir, path)
+			status.Extra = append(status.Extra, rel)
+		}
+	}
+	sort.Strings(status.New)
+	sort.Strings(status.Missing)
+	sort.Strings(status.Extra)
+	return status
+}
+
+// localArtifacts lists the finished files under dir, skipping partial
+// downloads and quarantined files
+func localArtifacts(dir string) map[string]bool {
+	files := make(map[string]bool)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == quarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, partSuffix) || strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		files[path] = true
+		return nil
+	})
+	return files
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fromsko/downhub/common"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/gocolly/colly/v2"
+)
+
+// ListTags lists every tag of a repository through `git ls-remote`,
+// resolving annotated tags to the commit they point at
+func ListTags(ctx context.Context, repoURL, proxy string) ([]common.Tag, error) {
+	return defaultSession().ListTags(ctx, repoURL, proxy)
+}
+
+// ListTags lists every tag of a repository through `git ls-remote`
+func (s *Session) ListTags(ctx context.Context, repoURL, proxy string) ([]common.Tag, error) {
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{strings.TrimSuffix(repoURL, "/")},
+	})
+
+	if timeout := s.listTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	ctx, err := s.gitContext(ctx, proxy)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		PeelingOption: git.AppendPeeled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list remote refs: %w", err)
+	}
+
+	commits := make(map[string]string)
+	peeled := make(map[string]string)
+	for _, ref := range refs {
+		if !ref.Name().IsTag() {
+			continue
+		}
+		name := ref.Name().Short()
+		if strings.HasSuffix(name, "^{}") {
+			peeled[strings.TrimSuffix(name, "^{}")] = ref.Hash().String()
+			continue
+		}
+		commits[name] = ref.Hash().String()
+	}
+
+	tags := make([]common.Tag, 0, len(commits))
+	for name, hash := range commits {
+		if commit, ok := peeled[name]; ok {
+			hash = commit
+		}
+		tags = append(tags, common.Tag{Name: name, Commit: hash})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// Tags discovers and selects the tags of a repository the way
+// DownloadRepo does, without downloading anything
+func (s *Session) Tags(ctx context.Context, url string, opts DownloadOptions) ([]common.Tag, error) {
+	hub := s.newHub(url, opts)
+	hub.Spider.Context = ctx
+	if err := s.discoverTags(ctx, hub, regexp.MustCompile(hub.Link())); err != nil {
+		return nil, err
+	}
+	if err := s.selectTags(hub); err != nil {
+		return nil, err
+	}
+	return hub.Tags, nil
+}
+
+// TagArchiveURLs builds the zip and tar.gz source archive URLs of a tag
+func TagArchiveURLs(repoURL, tag string) (zip, tarGz string) {
+	base := strings.TrimSuffix(repoURL, "/") + "/archive/refs/tags/" + tag
+	return base + ".zip", base + ".tar.gz"
+}
+
+// listTags records every tag found by ListTags on the hub
+func (s *Session) listTags(ctx context.Context, hub *common.DownHub) error {
+	tags, err := s.ListTags(ctx, hub.BaseUrl, hub.ProxyUrl)
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("no tags advertised by %s", hub.BaseUrl)
+	}
+
+	hub.Tags = tags
+	s.Log.Info("Found %d tags via ls-remote :> %s", len(tags), hub.BaseUrl)
+	return nil
+}
+
+// apiTags records tags from the GitHub REST API, keeping release metadata
+func (s *Session) apiTags(ctx context.Context, hub *common.DownHub) error {
+	client, err := s.httpClient(hub.ProxyUrl)
+	if err != nil {
+		return err
+	}
+
+	owner, repo := common.ParseRepo(hub.BaseUrl)
+	gh := common.NewGitHubClientFor(s.Config, client)
+	gh.Log = s.Log
+	releases, err := gh.Releases(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+	tags, err := gh.Tags(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("no tags returned by %s for %s/%s", gh.BaseURL, owner, repo)
+	}
+
+	hub.Tags = tags
+	hub.Releases = releases
+	s.Log.Info("Found %d tags, %d releases via API :> %s", len(tags), len(releases), hub.BaseUrl)
+	return nil
+}
+
+// selectTags narrows the discovered tags down with the hub selection policy
+func (s *Session) selectTags(hub *common.DownHub) error {
+	found := len(hub.Tags)
+	tags, err := common.SelectTags(hub.Tags, hub.Releases, hub.Selection)
+	if err != nil {
+		hub.Tags = nil
+		return fmt.Errorf("select tags: %w", err)
+	}
+	hub.Tags = tags
+	if len(tags) != found {
+		s.Log.Info("Selected %d of %d tags :> %s", len(tags), found, hub.BaseUrl)
+	}
+	return nil
+}
+
+// collectArchives adds the source archives of every discovered tag
+func collectArchives(hub *common.DownHub) {
+	if hub.NoSource {
+		return
+	}
+	for _, tag := range hub.Tags {
+		zip, tarGz := TagArchiveURLs(hub.BaseUrl, tag.Name)
+		if hub.Selection.Format != common.FormatTarGz {
+			hub.Filter(zip)
+		}
+		if hub.Selection.Format != common.FormatZip {
+			hub.Filter(tarGz)
+		}
+	}
+}
+
+// collectAssets adds the release assets of every discovered tag, from the
+// API releases when available and the expanded_assets fragment otherwise
+func (s *Session) collectAssets(hub *common.DownHub) {
+	if !hub.FetchAssets {
+		return
+	}
+	if hub.Releases != nil {
+		for _, release := range hub.Releases {
+			if release.Draft {
+				continue
+			}
+			for _, asset := range release.Assets {
+				asset.Tag = release.TagName
+				hub.AddAsset(asset)
+			}
+		}
+		return
+	}
+
+	var mu sync.Mutex
+	spider := hub.Spider.Clone()
+	s.throttleSpider(spider)
+	spider.OnHTML(`a[href*="/releases/download/"]`, func(e *colly.HTMLElement) {
+		link := e.Request.AbsoluteURL(e.Attr("href"))
+		mu.Lock()
+		defer mu.Unlock()
+		hub.AddAsset(common.Asset{
+			Tag:  e.Request.Ctx.Get("tag"),
+			Name: path.Base(link),
+			URL:  link,
+		})
+	})
+	for _, tag := range hub.Tags {
+		ctx := colly.NewContext()
+		ctx.Put("tag", tag.Name)
+		link := hub.BaseUrl + "/releases/expanded_assets/" + tag.Name
+		if err := spider.Request(http.MethodGet, link, nil, ctx, nil); err != nil {
+			s.Log.Warn("Visiting URL: %s - %v", link, err)
+		}
+	}
+	spider.Wait()
+	s.Log.Info("Found %d release assets :> %s", len(hub.Assets), hub.BaseUrl)
+}
+
+// listTimeout returns the ls-remote timeout in seconds from config
+func (s *Session) listTimeout() int {
+	if s.Config != nil && s.Config.Download.Timeout > 0 {
+		return s.Config.Download.Timeout
+	}
+	return 0
+}
@@ -13,12 +13,14 @@ import (
 type Level int
 
 const (
-	LevelInfo Level = iota
+	LevelDebug Level = iota - 1
+	LevelInfo
 	LevelWarn
 	LevelError
 )
 
 var (
+	debugColor = color.New(color.FgCyan).SprintFunc()
 	infoColor  = color.New(color.FgGreen).SprintFunc()
 	warnColor  = color.New(color.FgYellow).SprintFunc()
 	errorColor = color.New(color.FgRed).SprintFunc()
@@ -32,10 +34,15 @@ func SetConfig(c *config.Config) {
 
 func log(level Level, msg string, args ...any) {
 	// Check if we should log this level based on config
+	if cfg == nil && level == LevelDebug {
+		return
+	}
 	if cfg != nil {
 		configLevel := strings.ToLower(cfg.Logging.Level)
 		currentLevel := ""
 		switch level {
+		case LevelDebug:
+			currentLevel = "debug"
 		case LevelInfo:
 			currentLevel = "info"
 		case LevelWarn:
@@ -53,6 +60,8 @@ func log(level Level, msg string, args ...any) {
 	t := time.Now().Format("2006-01-02 15:04:05")
 	var levelStr string
 	switch level {
+	case LevelDebug:
+		levelStr = debugColor("DEBUG")
 	case LevelInfo:
 		levelStr = infoColor("INFO ")
 	case LevelWarn:
@@ -78,12 +87,13 @@ func log(level Level, msg string, args ...any) {
 
 // shouldSkipLog determines if a log message should be skipped based on level
 func shouldSkipLog(currentLevel, configLevel string) bool {
-	levels := map[string]int{"info": 0, "warn": 1, "error": 2}
+	levels := map[string]int{"debug": -1, "info": 0, "warn": 1, "error": 2}
 	current := levels[currentLevel]
 	configured := levels[configLevel]
 	return current < configured
 }
 
+func Debug(msg string, args ...any) { log(LevelDebug, msg, args...) }
 func Info(msg string, args ...any)  { log(LevelInfo, msg, args...) }
 func Warn(msg string, args ...any)  { log(LevelWarn, msg, args...) }
 func Error(msg string, args ...any) { log(LevelError, msg, args...) }
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"github.com/Fromsko/downhub/catalog"
 	"github.com/Fromsko/downhub/cmd"
 	"github.com/Fromsko/downhub/common"
 	"github.com/Fromsko/downhub/config"
 	"github.com/Fromsko/downhub/handler"
 	"github.com/Fromsko/downhub/logs"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -24,9 +28,27 @@ func main() {
 	common.SetConfig(cfg)
 	handler.SetConfig(cfg)
 	logs.SetConfig(cfg)
+	catalog.SetConfig(cfg)
 
-	if err := cmd.RootCmd.Execute(); err != nil {
+	// The first SIGINT/SIGTERM cancels the downloads, which keep their
+	// .part files for resuming; a second one kills the process
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		fmt.Fprintln(os.Stderr, "\n收到中断信号，正在停止下载… 再次按 Ctrl-C 强制退出")
+		cancel()
+	}()
+
+	err = cmd.RootCmd.ExecuteContext(ctx)
+	if closeErr := catalog.Close(); closeErr != nil {
+		fmt.Fprintln(os.Stderr, closeErr)
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(cmd.ExitCode(err))
 	}
 }